@@ -17,6 +17,7 @@
 package atom
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/elliotpeele/deepfreeze/utils"
@@ -50,6 +51,15 @@ func New(moleculeId string, cubeId string, size int64) *Atom {
 	}
 }
 
+// Parse a serialized atom header.
+func ParseAtom(buf []byte) (*Atom, error) {
+	a := &Atom{}
+	if err := json.Unmarshal(buf, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
 // Serialize the atom header.
 func (a *Atom) Header() ([]byte, error) {
 	return utils.ToJSON(a)
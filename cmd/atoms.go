@@ -16,37 +16,126 @@ package cmd
 
 import (
 	"fmt"
+	"text/tabwriter"
 
+	"github.com/elliotpeele/deepfreeze/tray"
+	"github.com/elliotpeele/deepfreeze/ui"
+	"github.com/elliotpeele/deepfreeze/utils"
 	"github.com/spf13/cobra"
 )
 
+// Summary of a single atom for listing.
+type atomSummary struct {
+	Id         string `json:"id"`
+	MoleculeId string `json:"molecule_id"`
+	Path       string `json:"path"`
+	TrayId     string `json:"tray_id"`
+	PartId     int64  `json:"part_id"`
+	CubeId     string `json:"cube_id"`
+	Size       int64  `json:"size"`
+	Hash       string `json:"hash"`
+	LinkTo     string `json:"link_to,omitempty"`
+}
+
 // atomsCmd represents the atoms command
 var atomsCmd = &cobra.Command{
-	Use:   "atoms",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Work your own magic here
-		fmt.Println("atoms called")
+	Use:   "atoms <molecule id or path>",
+	Short: "List the chunk map of a backed up file",
+	Long: `List every atom of a backed up file, in order, with the cube that holds
+it, its size, and its hash. Files can be selected by molecule id or by a
+path glob. Use this to find the cubes that must be retrieved before a
+file can be restored. Hard links hold a single empty atom, their content
+is found in the atoms of the file they link to. For example:
+
+deepfreeze list atoms --tray <id> src/etc/hosts
+deepfreeze list atoms <molecule id>`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("a molecule id or path is required")
+		}
+
+		dest, err := cmd.InheritedFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		asJSON, err := cmd.InheritedFlags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		trayId, err := cmd.PersistentFlags().GetString("tray")
+		if err != nil {
+			return err
+		}
+
+		var trays []*tray.Tray
+		if trayId != "" {
+			t, err := tray.Open(dest, trayId)
+			if err != nil {
+				return err
+			}
+			trays = append(trays, t)
+		} else {
+			trays, err = tray.List(dest)
+			if err != nil {
+				return err
+			}
+		}
+
+		summaries := []*atomSummary{}
+		for _, t := range trays {
+			for _, cd := range t.Cubes {
+				for _, fd := range cd.Files {
+					matched := fd.Id == args[0]
+					if !matched {
+						matched, err = utils.MatchPath(args[0], fd.Path)
+						if err != nil {
+							return err
+						}
+					}
+					if !matched {
+						continue
+					}
+					for _, a := range fd.Atoms {
+						summaries = append(summaries, &atomSummary{
+							Id:         a.Id,
+							MoleculeId: fd.Id,
+							Path:       fd.Path,
+							TrayId:     t.Id,
+							PartId:     a.PartId,
+							CubeId:     a.CubeId,
+							Size:       a.Size,
+							Hash:       a.Hash,
+							LinkTo:     fd.LinkTo,
+						})
+					}
+				}
+			}
+		}
+
+		if asJSON {
+			data, err := utils.ToJSON(summaries)
+			if err != nil {
+				return err
+			}
+			_, err = ui.Write(data)
+			return err
+		}
+
+		w := tabwriter.NewWriter(ui.New(), 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tMOLECULE\tPART\tCUBE\tSIZE\tHASH\tLINK TO")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n", s.Path, s.MoleculeId,
+				s.PartId, s.CubeId, s.Size, shortHash(s.Hash), s.LinkTo)
+		}
+		return w.Flush()
 	},
 }
 
 func init() {
 	listCmd.AddCommand(atomsCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// atomsCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// atomsCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-
+	atomsCmd.PersistentFlags().StringP("tray", "t", "",
+		"id of the tray to list, all trays if not set")
 }
@@ -15,7 +15,11 @@
 package cmd
 
 import (
+	"fmt"
+	"path/filepath"
+
 	"github.com/elliotpeele/deepfreeze/freezer"
+	"github.com/elliotpeele/deepfreeze/indexer"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -23,13 +27,26 @@ import (
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Back up a directory tree",
+	Long: `Back up every file under root into a new tray of encrypted, compressed
+cubes in the destination directory.
+
+A full backup stores every file. An incremental backup only stores files
+that changed since the last backup of root, and a differential backup
+only stores files that changed since the last full backup of root. Both
+record files that were deleted, so that restoring them reproduces the
+tree as it was at the time of the backup.
+
+Files whose size and timestamps are unchanged since the previous backup
+are not hashed again, their hashes are taken from the parent tray or the
+local hash cache. Exclude patterns and exclude files in gitignore syntax
+leave matching paths out of the backup, as do directories containing a
+.deepfreeze-ignore file or a CACHEDIR.TAG. For example:
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+deepfreeze backup --root /srv/data
+deepfreeze backup --root /srv/data --incremental
+deepfreeze backup --root /srv/data --differential --exclude '*.tmp'
+deepfreeze backup --root /home --exclude-from /etc/deepfreeze/excludes`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		root, err := cmd.PersistentFlags().GetString("root")
 		if err != nil {
@@ -46,16 +63,73 @@ to quickly create a Cobra application.`,
 			return err
 		}
 
+		cachedir, err := cmd.PersistentFlags().GetString("cachedir")
+		if err != nil {
+			return err
+		}
+		// Keep the cache next to the keyring unless told otherwise.
+		if !cmd.PersistentFlags().Changed("cachedir") {
+			cachedir = filepath.Join(filepath.Dir(filepath.Clean(keydir)), "cache")
+		}
+
 		excludes, err := cmd.PersistentFlags().GetStringSlice("exclude")
 		if err != nil {
 			return err
 		}
 
-		f, err := freezer.New(root, dest, keydir, excludes)
+		excludeFrom, err := cmd.PersistentFlags().GetStringSlice("exclude-from")
+		if err != nil {
+			return err
+		}
+
+		incremental, err := cmd.PersistentFlags().GetBool("incremental")
+		if err != nil {
+			return err
+		}
+
+		differential, err := cmd.PersistentFlags().GetBool("differential")
 		if err != nil {
 			return err
 		}
 
+		rehashAll, err := cmd.PersistentFlags().GetBool("rehash-all")
+		if err != nil {
+			return err
+		}
+
+		digesters, err := cmd.PersistentFlags().GetInt("hash-workers")
+		if err != nil {
+			return err
+		}
+
+		hashMemory, err := cmd.PersistentFlags().GetInt64("hash-memory")
+		if err != nil {
+			return err
+		}
+
+		mode := freezer.Full
+		switch {
+		case incremental && differential:
+			return fmt.Errorf("only one of incremental or differential may be given")
+		case incremental:
+			mode = freezer.Incremental
+		case differential:
+			mode = freezer.Differential
+		}
+
+		f, err := freezer.New(root, dest, keydir, excludes, excludeFrom, mode)
+		if err != nil {
+			return err
+		}
+
+		if cachedir != "" {
+			if err := f.SetCacheDir(cachedir); err != nil {
+				return err
+			}
+		}
+		f.SetRehashAll(rehashAll)
+		f.SetHashLimits(digesters, hashMemory)
+
 		if err := f.Freeze(); err != nil {
 			return err
 		}
@@ -78,7 +152,35 @@ func init() {
 		"path for storing encryption keys")
 	viper.BindPFlag("keydir", backupCmd.PersistentFlags().Lookup("keydir"))
 
+	backupCmd.PersistentFlags().String("cachedir", "",
+		"path for storing the local file hash cache, next to the keydir if not set, empty to disable")
+	viper.BindPFlag("cachedir", backupCmd.PersistentFlags().Lookup("cachedir"))
+
 	backupCmd.PersistentFlags().StringSliceP("exclude", "e", nil,
-		"directory paths to ignore")
+		"paths or glob patterns to ignore, patterns without a slash match file names")
 	viper.BindPFlag("exclude", backupCmd.PersistentFlags().Lookup("exclude"))
+
+	backupCmd.PersistentFlags().StringSlice("exclude-from", nil,
+		"files with exclude rules in gitignore syntax")
+	viper.BindPFlag("exclude-from", backupCmd.PersistentFlags().Lookup("exclude-from"))
+
+	backupCmd.PersistentFlags().Bool("incremental", false,
+		"only back up files that changed since the last backup of root")
+	viper.BindPFlag("incremental", backupCmd.PersistentFlags().Lookup("incremental"))
+
+	backupCmd.PersistentFlags().Bool("differential", false,
+		"only back up files that changed since the last full backup of root")
+	viper.BindPFlag("differential", backupCmd.PersistentFlags().Lookup("differential"))
+
+	backupCmd.PersistentFlags().Bool("rehash-all", false,
+		"hash every file, even if its size and timestamps are unchanged")
+	viper.BindPFlag("rehash-all", backupCmd.PersistentFlags().Lookup("rehash-all"))
+
+	backupCmd.PersistentFlags().Int("hash-workers", 0,
+		"number of files to hash at once, two per cpu if not set")
+	viper.BindPFlag("hash-workers", backupCmd.PersistentFlags().Lookup("hash-workers"))
+
+	backupCmd.PersistentFlags().Int64("hash-memory", indexer.DefaultMaxInFlight,
+		"maximum bytes of file data held in memory while hashing")
+	viper.BindPFlag("hash-memory", backupCmd.PersistentFlags().Lookup("hash-memory"))
 }
@@ -16,37 +16,99 @@ package cmd
 
 import (
 	"fmt"
+	"text/tabwriter"
+	"time"
 
+	"github.com/elliotpeele/deepfreeze/tray"
+	"github.com/elliotpeele/deepfreeze/ui"
+	"github.com/elliotpeele/deepfreeze/utils"
 	"github.com/spf13/cobra"
 )
 
+// Summary of a single backup for listing.
+type backupSummary struct {
+	Id               string    `json:"tray_id"`
+	CreatedAt        time.Time `json:"created_at"`
+	Type             string    `json:"type"`
+	ParentId         string    `json:"parent_id"`
+	Size             int64     `json:"size"`
+	Cubes            int       `json:"cubes"`
+	Files            int       `json:"files"`
+	ConsolidatedFrom string    `json:"consolidated_from"`
+}
+
+// Get the backup type of a tray.
+func trayType(t *tray.Tray) string {
+	if t.Differential {
+		return "differential"
+	}
+	if t.Incremental {
+		return "incremental"
+	}
+	return "full"
+}
+
 // backupsCmd represents the backups command
 var backupsCmd = &cobra.Command{
 	Use:   "backups",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Work your own magic here
-		fmt.Println("backups called")
-	},
-}
+	Short: "List all backups",
+	Long: `List every tray in the backup directory, oldest first, with its
+creation time, backup type, size, and the number of cubes and files it
+contains. Synthetic full backups show the tray they were consolidated
+from. For example:
 
-func init() {
-	listCmd.AddCommand(backupsCmd)
+deepfreeze list backups --dest /var/lib/deepfreeze/
+deepfreeze list backups --json`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dest, err := cmd.InheritedFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		asJSON, err := cmd.InheritedFlags().GetBool("json")
+		if err != nil {
+			return err
+		}
 
-	// Here you will define your flags and configuration settings.
+		trays, err := tray.List(dest)
+		if err != nil {
+			return err
+		}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// backupsCmd.PersistentFlags().String("foo", "", "A help for foo")
+		summaries := []*backupSummary{}
+		for _, t := range trays {
+			summaries = append(summaries, &backupSummary{
+				Id:               t.Id,
+				CreatedAt:        t.CreatedAt,
+				Type:             trayType(t),
+				ParentId:         t.ParentId,
+				Size:             t.Size,
+				Cubes:            len(t.Cubes),
+				Files:            t.FileCount(),
+				ConsolidatedFrom: t.ConsolidatedFrom,
+			})
+		}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// backupsCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+		if asJSON {
+			data, err := utils.ToJSON(summaries)
+			if err != nil {
+				return err
+			}
+			_, err = ui.Write(data)
+			return err
+		}
 
+		w := tabwriter.NewWriter(ui.New(), 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TRAY\tCREATED\tTYPE\tPARENT\tSIZE\tCUBES\tFILES\tCONSOLIDATED FROM")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", s.Id,
+				s.CreatedAt.Format(time.RFC3339), s.Type, orNone(s.ParentId),
+				s.Size, s.Cubes, s.Files, orNone(s.ConsolidatedFrom))
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	listCmd.AddCommand(backupsCmd)
 }
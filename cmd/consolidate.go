@@ -0,0 +1,69 @@
+// Copyright © 2016 Elliot Peele <elliot@bentlogic.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/elliotpeele/deepfreeze/freezer"
+	"github.com/elliotpeele/deepfreeze/ui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// consolidateCmd represents the consolidate command
+var consolidateCmd = &cobra.Command{
+	Use:   "consolidate",
+	Short: "Build a synthetic full backup from an incremental chain",
+	Long: `Create a new full tray with the state of a tray and the trays it builds
+on. The stored files are copied from the existing cubes, so the source
+machine is not read and no content is decrypted. Once consolidated, the
+old chain is no longer needed for restores. For example:
+
+deepfreeze consolidate --tray <id> --dest /var/lib/deepfreeze/`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		trayId, err := cmd.PersistentFlags().GetString("tray")
+		if err != nil {
+			return err
+		}
+		if trayId == "" {
+			return fmt.Errorf("a tray id is required")
+		}
+
+		dest, err := cmd.PersistentFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		t, err := freezer.Consolidate(trayId, dest)
+		if err != nil {
+			return err
+		}
+
+		ui.Printf("%s\n", t.Id)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(consolidateCmd)
+
+	consolidateCmd.PersistentFlags().StringP("tray", "t", "",
+		"id of the tray to consolidate")
+
+	consolidateCmd.PersistentFlags().String("dest", "/var/lib/deepfreeze/",
+		"path where backup data is stored")
+	viper.BindPFlag("dest", consolidateCmd.PersistentFlags().Lookup("dest"))
+}
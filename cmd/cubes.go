@@ -16,37 +16,174 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/elliotpeele/deepfreeze/cube"
+	"github.com/elliotpeele/deepfreeze/tray"
+	"github.com/elliotpeele/deepfreeze/ui"
+	"github.com/elliotpeele/deepfreeze/utils"
 	"github.com/spf13/cobra"
 )
 
+// Summary of a single cube for listing.
+type cubeSummary struct {
+	Id          string    `json:"cube_id"`
+	TrayId      string    `json:"tray_id"`
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	ParentId    string    `json:"parent_id"`
+	ChildId     string    `json:"child_id"`
+	AWSLocation string    `json:"aws_location"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	Problems    []string  `json:"problems"`
+}
+
+// Load the cube summary from the cube header, recording any problems with
+// the cube file.
+func loadCubeSummary(dest string, s *cubeSummary) error {
+	c, err := cube.Open(cube.Path(dest, s.Id))
+	if os.IsNotExist(err) {
+		s.Problems = append(s.Problems, "missing")
+		return nil
+	}
+	if err != nil {
+		s.Problems = append(s.Problems, fmt.Sprintf("unreadable: %s", err))
+		return nil
+	}
+	defer c.Close()
+
+	if s.TrayId == "" {
+		s.TrayId = c.TrayId
+	}
+	if s.Hash == "" {
+		s.Hash = c.Hash
+		s.Size = c.Size
+	}
+	s.ParentId = c.ParentId
+	s.ChildId = c.ChildId
+	s.AWSLocation = c.AWSLocation
+	s.UploadedAt = c.UploadedAt
+
+	size, err := c.StoredSize()
+	if err != nil {
+		return err
+	}
+	if size != s.Size {
+		s.Problems = append(s.Problems,
+			fmt.Sprintf("size mismatch: %d on disk", size))
+	}
+	return nil
+}
+
+// Format an optional value for table output.
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
 // cubesCmd represents the cubes command
 var cubesCmd = &cobra.Command{
 	Use:   "cubes",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Work your own magic here
-		fmt.Println("cubes called")
-	},
-}
+	Short: "List all cubes and their state",
+	Long: `List every cube in the backup directory with its hash, size, parent and
+child cubes, and upload state. Cubes that are missing from disk, whose
+size on disk differs from the recorded size, or that no tray references
+are flagged. For example:
 
-func init() {
-	listCmd.AddCommand(cubesCmd)
+deepfreeze list cubes --dest /var/lib/deepfreeze/`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dest, err := cmd.InheritedFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		asJSON, err := cmd.InheritedFlags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		trays, err := tray.List(dest)
+		if err != nil {
+			return err
+		}
+
+		// Start with the cubes referenced by trays, using the tray metadata as
+		// the recorded state.
+		cubes := make(map[string]*cubeSummary)
+		for _, t := range trays {
+			for _, cd := range t.Cubes {
+				cubes[cd.Id] = &cubeSummary{
+					Id:     cd.Id,
+					TrayId: t.Id,
+					Hash:   cd.Hash,
+					Size:   cd.Size,
+				}
+			}
+		}
 
-	// Here you will define your flags and configuration settings.
+		// Add any cube files that are not referenced.
+		ids, err := cube.List(dest)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, ok := cubes[id]; !ok {
+				cubes[id] = &cubeSummary{
+					Id:       id,
+					Problems: []string{"unreferenced"},
+				}
+			}
+		}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// cubesCmd.PersistentFlags().String("foo", "", "A help for foo")
+		summaries := []*cubeSummary{}
+		for _, s := range cubes {
+			if err := loadCubeSummary(dest, s); err != nil {
+				return err
+			}
+			summaries = append(summaries, s)
+		}
+		sort.Slice(summaries, func(i, j int) bool {
+			if summaries[i].TrayId != summaries[j].TrayId {
+				return summaries[i].TrayId < summaries[j].TrayId
+			}
+			return summaries[i].Id < summaries[j].Id
+		})
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// cubesCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+		if asJSON {
+			data, err := utils.ToJSON(summaries)
+			if err != nil {
+				return err
+			}
+			_, err = ui.Write(data)
+			return err
+		}
 
+		w := tabwriter.NewWriter(ui.New(), 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CUBE\tTRAY\tHASH\tSIZE\tPARENT\tCHILD\tAWS LOCATION\tUPLOADED\tSTATUS")
+		for _, s := range summaries {
+			uploaded := "-"
+			if !s.UploadedAt.IsZero() {
+				uploaded = s.UploadedAt.Format(time.RFC3339)
+			}
+			status := "ok"
+			if len(s.Problems) > 0 {
+				status = strings.Join(s.Problems, ", ")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", s.Id,
+				orNone(s.TrayId), orNone(shortHash(s.Hash)), s.Size,
+				orNone(s.ParentId), orNone(s.ChildId), orNone(s.AWSLocation),
+				uploaded, status)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	listCmd.AddCommand(cubesCmd)
 }
@@ -0,0 +1,148 @@
+// Copyright © 2016 Elliot Peele <elliot@bentlogic.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/elliotpeele/deepfreeze/tarfile"
+	"github.com/elliotpeele/deepfreeze/thawer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a backup as a tar, pax, or zip archive",
+	Long: `Write the files stored in a tray to a standard archive with their
+original modes and modification times. Use "-" as the output to stream
+the archive to stdout. For example:
+
+deepfreeze export --tray <id> --format tar -o - | ssh host tar x -C /restore
+deepfreeze export --tray <id> --format zip -o backup.zip`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		trayId, err := cmd.PersistentFlags().GetString("tray")
+		if err != nil {
+			return err
+		}
+		if trayId == "" {
+			return fmt.Errorf("a tray id is required")
+		}
+
+		format, err := cmd.PersistentFlags().GetString("format")
+		if err != nil {
+			return err
+		}
+
+		output, err := cmd.PersistentFlags().GetString("output")
+		if err != nil {
+			return err
+		}
+
+		stripPrefix, err := cmd.PersistentFlags().GetString("strip-prefix")
+		if err != nil {
+			return err
+		}
+
+		dest, err := cmd.PersistentFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		keydir, err := cmd.PersistentFlags().GetString("keydir")
+		if err != nil {
+			return err
+		}
+
+		includes, err := cmd.PersistentFlags().GetStringSlice("include")
+		if err != nil {
+			return err
+		}
+
+		excludes, err := cmd.PersistentFlags().GetStringSlice("exclude")
+		if err != nil {
+			return err
+		}
+
+		t, err := thawer.New(trayId, dest, keydir, includes, excludes)
+		if err != nil {
+			return err
+		}
+
+		var out io.WriteCloser = os.Stdout
+		if output != "-" {
+			out, err = os.Create(output)
+			if err != nil {
+				return err
+			}
+		}
+		defer out.Close()
+
+		var w tarfile.ArchiveWriter
+		switch format {
+		case "tar":
+			w = tarfile.New(out)
+		case "pax":
+			w = tarfile.NewFormat(out, tar.FormatPAX)
+		case "zip":
+			w = tarfile.NewZip(out)
+		default:
+			return fmt.Errorf("unknown archive format %s", format)
+		}
+
+		if err := t.Export(w, stripPrefix); err != nil {
+			return err
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		return out.Close()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+
+	exportCmd.PersistentFlags().StringP("tray", "t", "", "id of the tray to export")
+
+	exportCmd.PersistentFlags().StringP("format", "f", "tar",
+		"archive format, one of tar, pax, or zip")
+	viper.BindPFlag("format", exportCmd.PersistentFlags().Lookup("format"))
+
+	exportCmd.PersistentFlags().StringP("output", "o", "-",
+		"path to write the archive to, - for stdout")
+
+	exportCmd.PersistentFlags().String("strip-prefix", "",
+		"leading path to remove from archived file paths")
+
+	exportCmd.PersistentFlags().String("dest", "/var/lib/deepfreeze/",
+		"path where backup data is stored")
+	viper.BindPFlag("dest", exportCmd.PersistentFlags().Lookup("dest"))
+
+	exportCmd.PersistentFlags().String("keydir", "/var/lib/deepfreeze/keys/",
+		"path for storing encryption keys")
+
+	exportCmd.PersistentFlags().StringSliceP("include", "i", nil,
+		"path globs of files to export")
+
+	exportCmd.PersistentFlags().StringSliceP("exclude", "e", nil,
+		"path globs of files to skip")
+}
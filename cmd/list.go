@@ -18,6 +18,7 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // listCmd represents the list command
@@ -39,6 +40,12 @@ to quickly create a Cobra application.`,
 func init() {
 	RootCmd.AddCommand(listCmd)
 
+	listCmd.PersistentFlags().String("dest", "/var/lib/deepfreeze/",
+		"path where backup data is stored")
+	viper.BindPFlag("dest", listCmd.PersistentFlags().Lookup("dest"))
+
+	listCmd.PersistentFlags().Bool("json", false, "output as JSON")
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -16,37 +16,159 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/elliotpeele/deepfreeze/tray"
+	"github.com/elliotpeele/deepfreeze/ui"
+	"github.com/elliotpeele/deepfreeze/utils"
 	"github.com/spf13/cobra"
 )
 
+// Summary of a single backed up file for listing.
+type moleculeSummary struct {
+	Id        string    `json:"file_id"`
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Deleted   bool      `json:"deleted"`
+	LinkTo    string    `json:"link_to,omitempty"`
+	TrayId    string    `json:"tray_id"`
+	Cubes     []string  `json:"cubes"`
+}
+
+// Shorten a hash for table output.
+func shortHash(hash string) string {
+	if len(hash) > 16 {
+		return hash[:16]
+	}
+	return hash
+}
+
+// Summarize the files stored in trays, leaving out files that do not match
+// the path glob if one is given.
+func summarizeMolecules(trays []*tray.Tray, pattern string) ([]*moleculeSummary, error) {
+	summaries := []*moleculeSummary{}
+	for _, t := range trays {
+		for _, cd := range t.Cubes {
+			for _, fd := range cd.Files {
+				if pattern != "" {
+					matched, err := utils.MatchPath(pattern, fd.Path)
+					if err != nil {
+						return nil, err
+					}
+					if !matched {
+						continue
+					}
+				}
+				summaries = append(summaries, &moleculeSummary{
+					Id:        fd.Id,
+					Path:      fd.Path,
+					Hash:      fd.Hash,
+					Size:      fd.Size,
+					CreatedAt: fd.CreatedAt,
+					Deleted:   fd.Deleted,
+					LinkTo:    fd.LinkTo,
+					TrayId:    t.Id,
+					Cubes:     fd.Cubes,
+				})
+			}
+		}
+	}
+
+	// Group versions of the same path together, oldest first. Trays are
+	// already sorted by creation time.
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Path < summaries[j].Path
+	})
+	return summaries, nil
+}
+
 // moleculesCmd represents the molecules command
 var moleculesCmd = &cobra.Command{
 	Use:   "molecules",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Work your own magic here
-		fmt.Println("molecules called")
+	Short: "List backed up files",
+	Long: `List the files stored in a tray with their hash, size, creation time,
+and the cubes that hold their content. Hard links show the file they link
+to, whose cubes hold the shared content. Without a tray, the version history
+of every path across all trays is listed instead, including the backups
+that recorded a file as deleted. For example:
+
+deepfreeze list molecules --tray <id>
+deepfreeze list molecules --path 'etc/*.conf'`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dest, err := cmd.InheritedFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		asJSON, err := cmd.InheritedFlags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		trayId, err := cmd.PersistentFlags().GetString("tray")
+		if err != nil {
+			return err
+		}
+
+		pattern, err := cmd.PersistentFlags().GetString("path")
+		if err != nil {
+			return err
+		}
+
+		var trays []*tray.Tray
+		if trayId != "" {
+			t, err := tray.Open(dest, trayId)
+			if err != nil {
+				return err
+			}
+			trays = append(trays, t)
+		} else {
+			trays, err = tray.List(dest)
+			if err != nil {
+				return err
+			}
+		}
+
+		summaries, err := summarizeMolecules(trays, pattern)
+		if err != nil {
+			return err
+		}
+
+		if asJSON {
+			data, err := utils.ToJSON(summaries)
+			if err != nil {
+				return err
+			}
+			_, err = ui.Write(data)
+			return err
+		}
+
+		w := tabwriter.NewWriter(ui.New(), 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tHASH\tSIZE\tCREATED\tTRAY\tCUBES\tLINK TO")
+		for _, s := range summaries {
+			hash := shortHash(s.Hash)
+			if s.Deleted {
+				hash = "(deleted)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", s.Path, hash,
+				s.Size, s.CreatedAt.Format(time.RFC3339), s.TrayId,
+				strings.Join(s.Cubes, ","), s.LinkTo)
+		}
+		return w.Flush()
 	},
 }
 
 func init() {
 	listCmd.AddCommand(moleculesCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// moleculesCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// moleculesCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	moleculesCmd.PersistentFlags().StringP("tray", "t", "",
+		"id of the tray to list, all trays if not set")
 
+	moleculesCmd.PersistentFlags().StringP("path", "p", "",
+		"path glob of files to list")
 }
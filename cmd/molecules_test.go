@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elliotpeele/deepfreeze/freezer"
+	"github.com/elliotpeele/deepfreeze/tray"
+)
+
+func TestSummarizeMolecules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testsuite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "etc")
+	backupdir := filepath.Join(dir, "backup")
+	keydir := filepath.Join(dir, "keys")
+	for _, p := range []string{root, filepath.Join(root, "sub"), backupdir, keydir} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"app.conf", "hosts", "sub/a.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := freezer.New(root, backupdir, keydir, nil, nil, freezer.Full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	trays, err := tray.List(backupdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Patterns from the list molecules help.
+	tests := map[string][]string{
+		"etc/*.conf": {filepath.Join(root, "app.conf")},
+		"*a.txt":     {filepath.Join(root, "sub/a.txt")},
+	}
+	for pattern, expected := range tests {
+		summaries, err := summarizeMolecules(trays, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(summaries) != len(expected) {
+			t.Fatalf("unexpected number of files for %s: %d", pattern, len(summaries))
+		}
+		for i, s := range summaries {
+			if s.Path != expected[i] {
+				t.Fatalf("unexpected file for %s: %s", pattern, s.Path)
+			}
+		}
+	}
+}
@@ -16,37 +16,207 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/elliotpeele/deepfreeze/thawer"
+	"github.com/elliotpeele/deepfreeze/tray"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
+// Layouts accepted for points in time, local time unless a zone is given.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Parse a point in time given on the command line.
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse time %s", value)
+}
+
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
 	Use:   "restore",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Work your own magic here
-		fmt.Println("restore called")
+	Short: "Restore a directory tree from a backup",
+	Long: `Restore all files stored in a tray into a destination directory.
+Restoring an incremental tray merges it with the trays it builds on, and
+a point in time selects the most recent tray at or before that time.
+
+Each file is written back under its original path, relative to the
+target root. A leading prefix can be stripped from the stored paths, and
+files are never written outside of the target root. Include and exclude
+globs limit the restore to matching files, only reading the cubes that
+hold them. Globs starting with a slash match the whole stored path, other
+globs match any part of it, such as etc/*.conf or a file name.
+
+Permissions, access and modification times, extended attributes and ACLs
+are restored. When running as root, file ownership is restored as well, by
+numeric id or, when restoring on a different host, by user and group name.
+For example:
+
+deepfreeze restore --tray <id> --target-root /tmp/restore
+deepfreeze restore --tray <id> --target-root /tmp/restore --include 'etc/*.conf'
+deepfreeze restore --tray <id> --strip-prefix /srv --target-root /mnt/recovery
+deepfreeze restore --at 2026-10-01T03:00 --root /srv/data --target-root /tmp/restore
+deepfreeze restore --tray <id> --target-root /srv --map-owners
+deepfreeze restore --tray <id> --target-root /srv --xattr-filter 'user.*'`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		trayId, err := cmd.PersistentFlags().GetString("tray")
+		if err != nil {
+			return err
+		}
+
+		at, err := cmd.PersistentFlags().GetString("at")
+		if err != nil {
+			return err
+		}
+
+		backupRoot, err := cmd.PersistentFlags().GetString("root")
+		if err != nil {
+			return err
+		}
+
+		root, err := cmd.PersistentFlags().GetString("target-root")
+		if err != nil {
+			return err
+		}
+
+		stripPrefix, err := cmd.PersistentFlags().GetString("strip-prefix")
+		if err != nil {
+			return err
+		}
+
+		dest, err := cmd.PersistentFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		keydir, err := cmd.PersistentFlags().GetString("keydir")
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case trayId != "" && at != "":
+			return fmt.Errorf("only one of a tray id or a point in time may be given")
+		case at != "":
+			when, err := parseTime(at)
+			if err != nil {
+				return err
+			}
+			// Without a root the newest tray of any root would be picked.
+			if backupRoot == "" {
+				roots, err := tray.Roots(dest)
+				if err != nil {
+					return err
+				}
+				if len(roots) > 1 {
+					return fmt.Errorf("found backups of %s, select one with --root", strings.Join(roots, ", "))
+				}
+			}
+			t, err := tray.LatestBefore(dest, backupRoot, when)
+			if err != nil {
+				return err
+			}
+			if t == nil {
+				return fmt.Errorf("no backup found at or before %s", at)
+			}
+			trayId = t.Id
+		case trayId == "":
+			return fmt.Errorf("a tray id or point in time is required")
+		}
+
+		includes, err := cmd.PersistentFlags().GetStringSlice("include")
+		if err != nil {
+			return err
+		}
+
+		excludes, err := cmd.PersistentFlags().GetStringSlice("exclude")
+		if err != nil {
+			return err
+		}
+
+		mapOwners, err := cmd.PersistentFlags().GetBool("map-owners")
+		if err != nil {
+			return err
+		}
+
+		noXattrs, err := cmd.PersistentFlags().GetBool("no-xattrs")
+		if err != nil {
+			return err
+		}
+
+		xattrFilter, err := cmd.PersistentFlags().GetStringSlice("xattr-filter")
+		if err != nil {
+			return err
+		}
+
+		t, err := thawer.New(trayId, dest, keydir, includes, excludes)
+		if err != nil {
+			return err
+		}
+		t.SetMapOwners(mapOwners)
+		t.SetXattrs(!noXattrs, xattrFilter)
+
+		if err := t.Thaw(root, stripPrefix); err != nil {
+			return err
+		}
+
+		return nil
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(restoreCmd)
 
-	// Here you will define your flags and configuration settings.
+	restoreCmd.PersistentFlags().StringP("tray", "t", "", "id of the tray to restore")
+	viper.BindPFlag("tray", restoreCmd.PersistentFlags().Lookup("tray"))
+
+	restoreCmd.PersistentFlags().String("at", "",
+		"restore the most recent backup at or before this time")
+
+	restoreCmd.PersistentFlags().StringP("root", "r", "",
+		"path that was backed up, required to restore a point in time if more than one path has backups")
+
+	restoreCmd.PersistentFlags().String("target-root", ".",
+		"path to restore files into")
+	viper.BindPFlag("target-root", restoreCmd.PersistentFlags().Lookup("target-root"))
+
+	restoreCmd.PersistentFlags().String("strip-prefix", "",
+		"leading path to remove from restored file paths")
+	viper.BindPFlag("strip-prefix", restoreCmd.PersistentFlags().Lookup("strip-prefix"))
+
+	restoreCmd.PersistentFlags().String("dest", "/var/lib/deepfreeze/",
+		"path where backup data is stored")
+	viper.BindPFlag("dest", restoreCmd.PersistentFlags().Lookup("dest"))
+
+	restoreCmd.PersistentFlags().String("keydir", "/var/lib/deepfreeze/keys/",
+		"path for storing encryption keys")
+	viper.BindPFlag("keydir", restoreCmd.PersistentFlags().Lookup("keydir"))
+
+	restoreCmd.PersistentFlags().StringSliceP("include", "i", nil,
+		"path globs of files to restore")
+
+	restoreCmd.PersistentFlags().StringSliceP("exclude", "e", nil,
+		"path globs of files to skip")
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// restoreCmd.PersistentFlags().String("foo", "", "A help for foo")
+	restoreCmd.PersistentFlags().Bool("map-owners", false,
+		"restore ownership by user and group name instead of numeric id")
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// restoreCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	restoreCmd.PersistentFlags().Bool("no-xattrs", false,
+		"do not restore extended attributes and ACLs")
 
+	restoreCmd.PersistentFlags().StringSlice("xattr-filter", nil,
+		"only restore extended attributes with names matching these globs, such as 'user.*'")
 }
@@ -20,6 +20,7 @@ import (
 	"path"
 
 	"github.com/elliotpeele/deepfreeze/log"
+	"github.com/elliotpeele/deepfreeze/ui"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -33,6 +34,10 @@ var RootCmd = &cobra.Command{
 	Short: "Backup application for securely storing incremental backups",
 	Long: `Backup application designed to work with Amazon Glacier in
 mind, but can also handle local filesystem based backups.`,
+	// Errors are reported by Execute on stderr, stdout may be carrying an
+	// archive stream.
+	SilenceUsage:  true,
+	SilenceErrors: true,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		if _, err := os.Stat(cfgPath); os.IsNotExist(err) {
 			os.MkdirAll(cfgPath, 0755)
@@ -42,7 +47,7 @@ mind, but can also handle local filesystem based backups.`,
 		logFile = os.ExpandEnv(logFile)
 		f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
-			fmt.Printf("Error opening log file, defaulting to stderr: %s\n", err)
+			fmt.Fprintf(os.Stderr, "Error opening log file, defaulting to stderr: %s\n", err)
 			f = nil
 		}
 
@@ -55,7 +60,7 @@ mind, but can also handle local filesystem based backups.`,
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		ui.Error().Printf("Error: %s\n", err)
 		os.Exit(-1)
 	}
 }
@@ -88,6 +93,6 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
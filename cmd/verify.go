@@ -16,37 +16,184 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/elliotpeele/deepfreeze/tray"
+	"github.com/elliotpeele/deepfreeze/ui"
+	"github.com/elliotpeele/deepfreeze/verifier"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
+// Find the most recent backup of a directory tree to compare it with. The
+// most recent backup is used if all backups are of the same root, which may
+// have been given as a different path.
+func latestAgainst(dest string, against string) (*tray.Tray, error) {
+	t, err := tray.Latest(dest, against)
+	if err != nil || t != nil {
+		return t, err
+	}
+	roots, err := tray.Roots(dest)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) > 1 {
+		return nil, fmt.Errorf("no backup of %s found among backups of %s, select one with --tray",
+			against, strings.Join(roots, ", "))
+	}
+	return tray.Latest(dest, "")
+}
+
 // verifyCmd represents the verify command
 var verifyCmd = &cobra.Command{
 	Use:   "verify",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Work your own magic here
-		fmt.Println("verify called")
+	Short: "Verify the integrity of backups",
+	Long: `Re-hash every cube of a tray and compare it with the hash recorded in
+the tray metadata. Missing, truncated, and corrupted cubes are reported
+and the command exits nonzero if any are found. Without a tray, every
+tray in the backup directory is verified.
+
+A deep verify also decrypts and decompresses every file stored in the tray
+and compares the result with the hash recorded when the file was backed
+up, proving that the keyring can restore the data. Files stored in parent
+trays are checked when those trays are verified.
+
+Verifying against a directory tree re-indexes it and reports files that
+were added, deleted, modified, or had their metadata changed since the
+backup. Without a tray, the most recent backup of the tree is compared.
+The same exclude rules given to the backup should be given here. For
+example:
+
+deepfreeze verify --tray <id>
+deepfreeze verify --dest /var/lib/deepfreeze/
+deepfreeze verify --tray <id> --deep --keydir /var/lib/deepfreeze/keys/
+deepfreeze verify --tray <id> --against /srv/data`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		trayId, err := cmd.PersistentFlags().GetString("tray")
+		if err != nil {
+			return err
+		}
+
+		dest, err := cmd.PersistentFlags().GetString("dest")
+		if err != nil {
+			return err
+		}
+
+		deep, err := cmd.PersistentFlags().GetBool("deep")
+		if err != nil {
+			return err
+		}
+
+		keydir, err := cmd.PersistentFlags().GetString("keydir")
+		if err != nil {
+			return err
+		}
+
+		against, err := cmd.PersistentFlags().GetString("against")
+		if err != nil {
+			return err
+		}
+
+		excludes, err := cmd.PersistentFlags().GetStringSlice("exclude")
+		if err != nil {
+			return err
+		}
+
+		excludeFrom, err := cmd.PersistentFlags().GetStringSlice("exclude-from")
+		if err != nil {
+			return err
+		}
+
+		var trayIds []string
+		switch {
+		case trayId != "":
+			trayIds = append(trayIds, trayId)
+		case against != "":
+			// Only the most recent backup of the tree is compared with it.
+			t, err := latestAgainst(dest, against)
+			if err != nil {
+				return err
+			}
+			if t != nil {
+				trayIds = append(trayIds, t.Id)
+			}
+		default:
+			// Every tray file is checked, including those that can not be
+			// read.
+			trayIds, err = tray.Ids(dest)
+			if err != nil {
+				return err
+			}
+		}
+
+		var problems []*verifier.Problem
+		for _, id := range trayIds {
+			v, err := verifier.New(id, dest)
+			if err != nil {
+				problems = append(problems, &verifier.Problem{
+					TrayId: id,
+					Id:     id,
+					Reason: fmt.Sprintf("unreadable: %s", err),
+				})
+				continue
+			}
+			p, err := v.VerifyCubes()
+			if err != nil {
+				return err
+			}
+			problems = append(problems, p...)
+			if against != "" {
+				drift, err := v.VerifyAgainst(against, excludes, excludeFrom)
+				if err != nil {
+					return err
+				}
+				problems = append(problems, drift...)
+			}
+			// Restoring from damaged cubes is known to fail.
+			if !deep || len(p) > 0 {
+				continue
+			}
+			p, err = v.VerifyMolecules(keydir)
+			if err != nil {
+				return err
+			}
+			problems = append(problems, p...)
+		}
+
+		for _, p := range problems {
+			ui.Printf("%s\t%s\n", p.TrayId, p)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("verification failed with %d problems", len(problems))
+		}
+		ui.Printf("verified %d trays\n", len(trayIds))
+		return nil
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(verifyCmd)
 
-	// Here you will define your flags and configuration settings.
+	verifyCmd.PersistentFlags().StringP("tray", "t", "",
+		"id of the tray to verify, all trays if not set")
+
+	verifyCmd.PersistentFlags().String("dest", "/var/lib/deepfreeze/",
+		"path where backup data is stored")
+	viper.BindPFlag("dest", verifyCmd.PersistentFlags().Lookup("dest"))
+
+	verifyCmd.PersistentFlags().Bool("deep", false,
+		"decrypt and re-hash the content of every file")
+
+	verifyCmd.PersistentFlags().String("against", "",
+		"directory tree to compare the backup with")
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// verifyCmd.PersistentFlags().String("foo", "", "A help for foo")
+	verifyCmd.PersistentFlags().StringSliceP("exclude", "e", nil,
+		"paths or glob patterns to ignore when comparing with a directory tree")
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// verifyCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	verifyCmd.PersistentFlags().StringSlice("exclude-from", nil,
+		"files with exclude rules in gitignore syntax")
 
+	verifyCmd.PersistentFlags().String("keydir", "/var/lib/deepfreeze/keys/",
+		"path for storing encryption keys")
+	viper.BindPFlag("keydir", verifyCmd.PersistentFlags().Lookup("keydir"))
 }
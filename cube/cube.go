@@ -17,6 +17,7 @@
 package cube
 
 import (
+	"bytes"
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"path"
 	"time"
 
+	"github.com/elliotpeele/deepfreeze/atom"
 	"github.com/elliotpeele/deepfreeze/fileinfo"
 	"github.com/elliotpeele/deepfreeze/log"
 	"github.com/elliotpeele/deepfreeze/molecule"
@@ -55,12 +57,14 @@ type Cube struct {
 	tf          *tarfile.TarFile
 	max_size    int64
 	size        int64
+	readonly    bool
+	header_size int64
 }
 
 // Create a new cube isntance.
 func New(size int64, backupdir string) (*Cube, error) {
 	id := uuid.NewV4().String()
-	fobj, err := os.Create(path.Join(backupdir, id))
+	fobj, err := os.Create(Path(backupdir, id))
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +92,7 @@ func Open(name string) (*Cube, error) {
 	c := &Cube{
 		backingfile: fobj,
 		tf:          tarfile.Open(fobj),
+		readonly:    true,
 	}
 	if err := c.unpackHeader(); err != nil {
 		return nil, err
@@ -95,6 +100,31 @@ func Open(name string) (*Cube, error) {
 	return c, nil
 }
 
+// Find the ids of all cube files in the backup directory.
+func List(backupdir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(backupdir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		// Cube files are named after their ids.
+		if _, err := uuid.FromString(entry.Name()); err != nil {
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+	return ids, nil
+}
+
+// Get the path of a cube file in the backup directory.
+func Path(backupdir string, id string) string {
+	return path.Join(backupdir, id)
+}
+
 // Write a molecule to the cube backing store.
 func (c *Cube) WriteMolecule(m *molecule.Molecule) (n int, err error) {
 	cur := c
@@ -135,6 +165,15 @@ func (c *Cube) WriteMolecule(m *molecule.Molecule) (n int, err error) {
 		return 0, err
 	}
 
+	// Molecules without content, such as hard links, get a single empty atom
+	// so that they are complete when read back.
+	if m.Size() == 0 {
+		if err := cur.writeEmptyAtom(m.NewAtom(cur.Id, 0)); err != nil {
+			return 0, err
+		}
+		return int(cur.tf.Size() - orig_size), nil
+	}
+
 	// Write the current file contents.
 	written := int64(0)
 	for m.Size() > 0 {
@@ -145,6 +184,10 @@ func (c *Cube) WriteMolecule(m *molecule.Molecule) (n int, err error) {
 
 		// Create a new atom
 		a := m.NewAtom(cur.Id, size)
+		a.Hash, err = m.PeekHash(size)
+		if err != nil {
+			return 0, err
+		}
 
 		// Write the atom metadata
 		atomHeader, err := a.Header()
@@ -189,17 +232,70 @@ func (c *Cube) WriteMolecule(m *molecule.Molecule) (n int, err error) {
 	return int(c.tf.Size() - orig_size), nil
 }
 
+// Read the next metadata record from the cube.
+func (c *Cube) ReadMetadata() (*tarfile.MetadataRecord, error) {
+	return c.tf.ReadMetadata()
+}
+
+// Read the content of the next file in the cube into the specified writer.
+func (c *Cube) ReadFile(w io.Writer) (os.FileInfo, error) {
+	return c.tf.ReadFile(w)
+}
+
+// Write a tombstone for a deleted file to the cube backing store. The
+// tombstone is a molecule with a single empty atom marked for deletion.
+func (c *Cube) WriteTombstone(m *molecule.Molecule) error {
+	c.Molecules = append(c.Molecules, m)
+
+	molHeader, err := m.Header()
+	if err != nil {
+		return err
+	}
+	if _, err := c.tf.WriteMetadata("molecule", molHeader); err != nil {
+		return err
+	}
+
+	a := m.NewAtom(c.Id, 0)
+	a.Delete = true
+	return c.writeEmptyAtom(a)
+}
+
+// Write an atom without content to the cube backing store.
+func (c *Cube) writeEmptyAtom(a *atom.Atom) error {
+	// Hashed like any other atom, the content is just empty.
+	a.Hash = fmt.Sprintf("%x", sha512.Sum512(nil))
+	atomHeader, err := a.Header()
+	if err != nil {
+		return err
+	}
+	if _, err := c.tf.WriteMetadata("atom", atomHeader); err != nil {
+		return err
+	}
+
+	info := &fileinfo.FileInfo{
+		Name: a.Id,
+		Size: 0,
+	}
+	if _, err := c.tf.WriteFile(info.FileInfo(), &bytes.Buffer{}); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Close and finalize the cube.
 func (c *Cube) Close() error {
+	// Cubes opened from the backing store only need to release the file.
+	if c.readonly {
+		return c.backingfile.Close()
+	}
+
 	// Copy data to cube structure.
 	if c.Parent != nil {
 		c.ParentId = c.Parent.Id
 	}
 	if c.Child != nil {
-		c.ChildId = c.ChildId
+		c.ChildId = c.Child.Id
 	}
-	c.Size = c.tf.Size()
-
 	// Close the tarfile abstraction.
 	if err := c.tf.Close(); err != nil {
 		return err
@@ -211,10 +307,13 @@ func (c *Cube) Close() error {
 	}
 	// Hash cube.
 	h := sha512.New()
-	if _, err := io.Copy(h, c.backingfile); err != nil {
+	n, err := io.Copy(h, c.backingfile)
+	if err != nil {
 		return err
 	}
 	c.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	// Record the size of the hashed content.
+	c.Size = n
 
 	// Create tmp file for writing cube header.
 	tmpf, err := ioutil.TempFile(c.backupdir, "deepfreeze")
@@ -305,14 +404,40 @@ func (c *Cube) packHeader() error {
 
 func (c *Cube) unpackHeader() error {
 	md, err := c.tf.ReadMetadata()
-	if md.Name != "cube" {
-		return fmt.Errorf("expected cube metadata, found %s", md.Name)
-	}
 	if err != nil {
 		return err
 	}
+	if md.Name != "cube" {
+		return fmt.Errorf("expected cube metadata, found %s", md.Name)
+	}
 	if err := json.Unmarshal(md.Data, c); err != nil {
 		return err
 	}
+	// The header is a single tar record padded to the tar block size.
+	c.header_size = 512 + (int64(len(md.Data))+511)/512*512
 	return nil
 }
+
+// Compute the SHA512 hash and size of the cube content in the backing file,
+// excluding the cube header.
+func (c *Cube) ComputeHash() (string, int64, error) {
+	if _, err := c.backingfile.Seek(c.header_size, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	h := sha512.New()
+	n, err := io.Copy(h, c.backingfile)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+// Get the size of the cube content in the backing file, excluding the cube
+// header.
+func (c *Cube) StoredSize() (int64, error) {
+	info, err := c.backingfile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() - c.header_size, nil
+}
@@ -17,6 +17,7 @@
 package fileinfo
 
 import (
+	"bytes"
 	"encoding/json"
 	"os"
 	"time"
@@ -25,12 +26,27 @@ import (
 )
 
 type FileInfo struct {
-	Name    string      `json:"name"`
-	Size    int64       `json:"size"`
-	Mode    os.FileMode `json:"mode"`
-	ModTime time.Time   `json:"mod_time"`
-	IsDir   bool        `json:"is_dir"`
-	Sys     interface{} `json:"sys"`
+	Name       string      `json:"name"`
+	Size       int64       `json:"size"`
+	Mode       os.FileMode `json:"mode"`
+	ModTime    time.Time   `json:"mod_time"`
+	IsDir      bool        `json:"is_dir"`
+	Sys        interface{} `json:"-"`
+	Device     uint64      `json:"device"`
+	Inode      uint64      `json:"inode"`
+	Nlink      uint64      `json:"-"`
+	Uid        int         `json:"uid"`
+	Gid        int         `json:"gid"`
+	User       string      `json:"user,omitempty"`
+	Group      string      `json:"group,omitempty"`
+	AccessTime time.Time   `json:"access_time"`
+	ChangeTime time.Time   `json:"change_time"`
+	LinkTarget string      `json:"link_target,omitempty"`
+	DevMajor   uint32      `json:"dev_major,omitempty"`
+	DevMinor   uint32      `json:"dev_minor,omitempty"`
+	// Extended attributes, including POSIX ACLs as system.posix_acl_access
+	// and system.posix_acl_default.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
 }
 
 type finfo struct {
@@ -40,10 +56,17 @@ type finfo struct {
 	modTime time.Time
 	isDir   bool
 	sys     interface{}
+	info    FileInfo
 }
 
 func NewFileInfo(fi os.FileInfo) *FileInfo {
-	return &FileInfo{
+	// Info that was read back from a backup no longer has the platform
+	// specific stat structure, so carry over what was recorded.
+	if i, ok := fi.(*finfo); ok {
+		info := i.info
+		return &info
+	}
+	info := &FileInfo{
 		Name:    fi.Name(),
 		Size:    fi.Size(),
 		Mode:    fi.Mode(),
@@ -51,6 +74,27 @@ func NewFileInfo(fi os.FileInfo) *FileInfo {
 		IsDir:   fi.IsDir(),
 		Sys:     fi.Sys(),
 	}
+	statSys(info, fi)
+	return info
+}
+
+// Get the info of a file without following symlinks. The target of symlinks
+// and the extended attributes of other files are read as well.
+func Lstat(path string) (*FileInfo, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	info := NewFileInfo(fi)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		info.LinkTarget, err = os.Readlink(path)
+	} else {
+		info.Xattrs, err = listXattrs(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
 }
 
 func ParseFileInfo(buf []byte) (*FileInfo, error) {
@@ -73,7 +117,35 @@ func (fi *FileInfo) FileInfo() os.FileInfo {
 		modTime: fi.ModTime,
 		isDir:   fi.IsDir,
 		sys:     fi.Sys,
+		info:    *fi,
+	}
+}
+
+// Check if the file described by other looks unchanged, comparing the size,
+// modification time, inode and change time. Info without an inode, such as
+// info recorded by older backups, never matches.
+func (fi *FileInfo) Matches(other *FileInfo) bool {
+	if fi.Inode == 0 || other.Inode == 0 {
+		return false
+	}
+	return fi.Size == other.Size &&
+		fi.ModTime.Equal(other.ModTime) &&
+		fi.Inode == other.Inode &&
+		fi.ChangeTime.Equal(other.ChangeTime)
+}
+
+// Check if the file described by other has the same extended attributes.
+func (fi *FileInfo) SameXattrs(other *FileInfo) bool {
+	if len(fi.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	for name, value := range fi.Xattrs {
+		v, ok := other.Xattrs[name]
+		if !ok || !bytes.Equal(value, v) {
+			return false
+		}
 	}
+	return true
 }
 
 func (i *finfo) Name() string {
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fileinfo
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileInfoRoundTrip(t *testing.T) {
+	info, err := os.Stat("../testdata/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := NewFileInfo(info)
+
+	buf, err := orig.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseFileInfo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Info read back from a backup keeps everything that was recorded.
+	fi := NewFileInfo(parsed.FileInfo())
+	if fi.Uid != orig.Uid || fi.Gid != orig.Gid ||
+		fi.User != orig.User || fi.Group != orig.Group {
+		t.Fatalf("ownership changed: %d:%d %s:%s", fi.Uid, fi.Gid, fi.User, fi.Group)
+	}
+	if !fi.AccessTime.Equal(orig.AccessTime) ||
+		!fi.ModTime.Equal(orig.ModTime) ||
+		!fi.ChangeTime.Equal(orig.ChangeTime) {
+		t.Fatal("times changed")
+	}
+	if !fi.Matches(orig) {
+		t.Fatal("expected file info to match")
+	}
+}
+
+func TestFileInfoMatches(t *testing.T) {
+	info := &FileInfo{
+		Size:       11358,
+		ModTime:    time.Unix(1500000000, 0),
+		Inode:      42,
+		ChangeTime: time.Unix(1500000000, 0),
+	}
+
+	tests := map[string]func(fi *FileInfo){
+		"size":     func(fi *FileInfo) { fi.Size++ },
+		"mtime":    func(fi *FileInfo) { fi.ModTime = fi.ModTime.Add(time.Nanosecond) },
+		"inode":    func(fi *FileInfo) { fi.Inode++ },
+		"ctime":    func(fi *FileInfo) { fi.ChangeTime = fi.ChangeTime.Add(time.Second) },
+		"no inode": func(fi *FileInfo) { fi.Inode = 0 },
+	}
+	for name, change := range tests {
+		other := *info
+		change(&other)
+		if info.Matches(&other) || other.Matches(info) {
+			t.Fatalf("expected a change of %s not to match", name)
+		}
+	}
+
+	// Other metadata does not affect the content.
+	other := *info
+	other.Mode = 0600
+	other.AccessTime = time.Now()
+	if !info.Matches(&other) {
+		t.Fatal("expected file info to match")
+	}
+}
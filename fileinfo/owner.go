@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fileinfo
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// Names of users and groups by id, looked up once per run.
+var (
+	ownerMtx   sync.Mutex
+	userNames  = make(map[int]string)
+	groupNames = make(map[int]string)
+)
+
+// Get the name of a user, or an empty string if it is not known.
+func lookupUser(uid int) string {
+	ownerMtx.Lock()
+	defer ownerMtx.Unlock()
+	name, ok := userNames[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
+		}
+		userNames[uid] = name
+	}
+	return name
+}
+
+// Get the name of a group, or an empty string if it is not known.
+func lookupGroup(gid int) string {
+	ownerMtx.Lock()
+	defer ownerMtx.Unlock()
+	name, ok := groupNames[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			name = g.Name
+		}
+		groupNames[gid] = name
+	}
+	return name
+}
+
+// Get the owner to restore a file with. When mapping by name, the ids of
+// the recorded user and group names on this host are used, falling back to
+// the recorded ids for names that do not exist here.
+func (fi *FileInfo) Owner(byName bool) (int, int) {
+	uid, gid := fi.Uid, fi.Gid
+	if !byName {
+		return uid, gid
+	}
+	if fi.User != "" {
+		if u, err := user.Lookup(fi.User); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+	}
+	if fi.Group != "" {
+		if g, err := user.LookupGroup(fi.Group); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+	}
+	return uid, gid
+}
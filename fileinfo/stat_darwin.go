@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fileinfo
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Fill in the device, inode, link count, ownership, access and change times
+// and device numbers from the stat structure of a file.
+func statSys(info *FileInfo, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	info.Device = uint64(st.Dev)
+	info.Inode = uint64(st.Ino)
+	info.Nlink = uint64(st.Nlink)
+	info.Uid = int(st.Uid)
+	info.Gid = int(st.Gid)
+	info.User = lookupUser(info.Uid)
+	info.Group = lookupGroup(info.Gid)
+	info.AccessTime = time.Unix(int64(st.Atimespec.Sec), int64(st.Atimespec.Nsec))
+	info.ChangeTime = time.Unix(int64(st.Ctimespec.Sec), int64(st.Ctimespec.Nsec))
+	if fi.Mode()&os.ModeDevice != 0 {
+		info.DevMajor, info.DevMinor = splitDev(uint64(st.Rdev))
+	}
+}
+
+// Split a device number into its major and minor numbers.
+func splitDev(dev uint64) (uint32, uint32) {
+	return uint32((dev >> 24) & 0xff), uint32(dev & 0xffffff)
+}
+
+// Get the device number of a device file from its major and minor numbers.
+func (fi *FileInfo) DeviceNumber() uint64 {
+	return uint64(fi.DevMajor)<<24 | uint64(fi.DevMinor)&0xffffff
+}
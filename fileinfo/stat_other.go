@@ -0,0 +1,34 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fileinfo
+
+import (
+	"os"
+)
+
+// Devices, inodes, ownership and change times are not available on this
+// platform, so files always look changed.
+func statSys(info *FileInfo, fi os.FileInfo) {
+}
+
+// Device numbers are not available on this platform.
+func (fi *FileInfo) DeviceNumber() uint64 {
+	return 0
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fileinfo
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Read all extended attributes of a file. Files on filesystems without
+// extended attribute support have none.
+func listXattrs(path string) (map[string][]byte, error) {
+	buf, err := readXattr(func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf), "\x00"), "\x00") {
+		value, err := readXattr(func(dest []byte) (int, error) {
+			return syscall.Getxattr(path, name, dest)
+		})
+		// The attribute was removed since it was listed.
+		if err == syscall.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// Call an extended attribute syscall, first to get the size of the result
+// and then to read it, retrying if the result grew in between.
+func readXattr(call func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := call(buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// Set an extended attribute of a file.
+func SetXattr(path string, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
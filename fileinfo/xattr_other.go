@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fileinfo
+
+import "fmt"
+
+// Extended attributes are not supported on this platform.
+func listXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// Extended attributes are not supported on this platform.
+func SetXattr(path string, name string, value []byte) error {
+	return fmt.Errorf("unable to set %s on %s: extended attributes are not supported", name, path)
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package freezer
+
+import (
+	"github.com/elliotpeele/deepfreeze/log"
+	"github.com/elliotpeele/deepfreeze/molecule"
+	"github.com/elliotpeele/deepfreeze/thawer"
+	"github.com/elliotpeele/deepfreeze/tray"
+)
+
+// Create a synthetic full backup with the state of a tray and its parents.
+// The stored molecules are copied into new cubes as they are, so the source
+// filesystem is not read and no content is decrypted. Returns the new tray.
+func Consolidate(trayId string, backupdir string) (*tray.Tray, error) {
+	src, err := tray.Open(backupdir, trayId)
+	if err != nil {
+		return nil, err
+	}
+
+	// No keys are needed since the content is copied without decrypting.
+	th, err := thawer.New(trayId, backupdir, "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := tray.New(src.Root, backupdir)
+	if err != nil {
+		return nil, err
+	}
+	// The new tray represents the same point in time as the source.
+	t.CreatedAt = src.CreatedAt
+	t.ConsolidatedFrom = src.Id
+
+	log.Infof("consolidating %s into %s", src.Id, t.Id)
+	err = th.WalkPacked(func(m *molecule.Molecule) error {
+		// New atoms are created as the content is written to the new cubes.
+		m.Atoms = nil
+		_, err := t.WritePackedMolecule(m)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the last cube in the tray. The other cubes get closed in the
+	// process of writing out the molecules.
+	if err := t.CurrentCube().Close(); err != nil {
+		return nil, err
+	}
+
+	if err := t.Save(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package freezer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConsolidate(t *testing.T) {
+	dir, root, backupdir, keydir := makeDirs(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, root, map[string]string{
+		"a":     "alpha",
+		"sub/b": "bravo",
+		"sub/c": "charlie",
+	})
+	freezeRoot(t, root, backupdir, keydir, Full)
+	writeFiles(t, root, map[string]string{"a": "alpha changed", "d": "delta"})
+	freezeRoot(t, root, backupdir, keydir, Incremental)
+	if err := os.Remove(filepath.Join(root, "sub", "c")); err != nil {
+		t.Fatal(err)
+	}
+	src := freezeRoot(t, root, backupdir, keydir, Incremental)
+
+	tr, err := Consolidate(src.Id, backupdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.Full || tr.ParentId != "" || tr.ConsolidatedFrom != src.Id {
+		t.Fatalf("expected a full backup consolidated from %s", src.Id)
+	}
+	if !tr.CreatedAt.Equal(src.CreatedAt) {
+		t.Fatalf("expected the time of %s, found %s", src.Id, tr.CreatedAt)
+	}
+
+	// The consolidated tray holds the newest version of every file in the
+	// chain, without the deleted ones.
+	chain := src.Files()
+	files := tr.Files()
+	if len(files) != len(chain) {
+		t.Fatalf("expected %d files, found %d", len(chain), len(files))
+	}
+	for p, fd := range chain {
+		if files[p] == nil || files[p].Hash != fd.Hash {
+			t.Fatalf("unexpected version of %s", p)
+		}
+	}
+
+	expected := thawRoot(t, src.Id, root, backupdir, keydir, filepath.Join(dir, "chain"))
+	restored := thawRoot(t, tr.Id, root, backupdir, keydir, filepath.Join(dir, "consolidated"))
+	checkFiles(t, restored, expected)
+	checkFiles(t, expected, map[string]string{
+		"a":     "alpha changed",
+		"d":     "delta",
+		"sub/b": "bravo",
+	})
+}
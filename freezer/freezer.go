@@ -17,28 +17,45 @@
 package freezer
 
 import (
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
-	"os"
-	"path"
+	"sort"
 
 	"github.com/elliotpeele/deepfreeze/encrypt"
+	"github.com/elliotpeele/deepfreeze/fileinfo"
 	"github.com/elliotpeele/deepfreeze/indexer"
 	"github.com/elliotpeele/deepfreeze/log"
 	"github.com/elliotpeele/deepfreeze/molecule"
 	"github.com/elliotpeele/deepfreeze/tray"
 )
 
+// Backup modes.
+type Mode int
+
+const (
+	// Back up every file.
+	Full Mode = iota
+	// Only back up files that changed since the most recent backup.
+	Incremental
+	// Only back up files that changed since the most recent full backup.
+	Differential
+)
+
 // High level backup structure.
 type Freezer struct {
 	tray      *tray.Tray
 	indexer   *indexer.Indexer
+	root      string
 	backupdir string
 	em        *encrypt.EncryptionManager
+	mode      Mode
 }
 
-// Create a new freezer instance.
-func New(root string, backupdir string, keyringdir string, excludes []string) (*Freezer, error) {
-	t, err := tray.New(backupdir)
+// Create a new freezer instance. Paths matching the exclude patterns or the
+// gitignore style rules in the excludeFrom files are not backed up.
+func New(root string, backupdir string, keyringdir string, excludes []string, excludeFrom []string, mode Mode) (*Freezer, error) {
+	t, err := tray.New(root, backupdir)
 	if err != nil {
 		return nil, err
 	}
@@ -50,36 +67,160 @@ func New(root string, backupdir string, keyringdir string, excludes []string) (*
 	if err := em.GenKey(); err != nil {
 		return nil, err
 	}
+	idx := indexer.New(root, excludes)
+	for _, path := range excludeFrom {
+		if err := idx.LoadExcludeFile(path); err != nil {
+			return nil, err
+		}
+	}
 	return &Freezer{
 		tray:      t,
-		indexer:   indexer.New(root, excludes),
+		indexer:   idx,
+		root:      root,
 		em:        em,
 		backupdir: backupdir,
+		mode:      mode,
 	}, nil
 }
 
+// Keep a local cache of file hashes in cachedir, so that files that look
+// unchanged are not hashed again even without a parent backup.
+func (f *Freezer) SetCacheDir(cachedir string) error {
+	cache, err := indexer.OpenCache(cachedir, f.root)
+	if err != nil {
+		return err
+	}
+	f.indexer.SetCache(cache)
+	return nil
+}
+
+// Hash every file, even if it looks unchanged since the parent backup or has
+// a hash in the cache.
+func (f *Freezer) SetRehashAll(rehashAll bool) {
+	f.indexer.SetRehashAll(rehashAll)
+}
+
+// Limit the number of files hashed at once and the memory used for reading
+// them while indexing. Zero selects the indexer defaults.
+func (f *Freezer) SetHashLimits(digesters int, maxInFlight int64) {
+	f.indexer.SetLimits(digesters, maxInFlight)
+}
+
+// Find the tray that an incremental backup builds on. Returns nil if there
+// is no earlier backup to build on.
+func (f *Freezer) findParent() (*tray.Tray, error) {
+	var parent *tray.Tray
+	var err error
+	switch f.mode {
+	case Incremental:
+		parent, err = tray.Latest(f.backupdir, f.root)
+	case Differential:
+		parent, err = tray.LatestFull(f.backupdir, f.root)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		log.Infof("no previous backup of %s, creating a full backup", f.root)
+		return nil, nil
+	}
+	if err := parent.LoadParents(); err != nil {
+		return nil, err
+	}
+	return parent, nil
+}
+
 // Create a backup from a diretory tree.
 func (f *Freezer) Freeze() error {
+	parent, err := f.findParent()
+	if err != nil {
+		return err
+	}
+	// Hashes and metadata of the files already stored in the parent backup
+	// chain, and the files that hard links were stored as links to.
+	stored := make(map[string]string)
+	storedInfo := make(map[string]*fileinfo.FileInfo)
+	storedLinks := make(map[string]string)
+	previous := make(map[string]*indexer.Entry)
+	if parent != nil {
+		if f.mode == Differential {
+			log.Infof("creating differential backup on top of %s", parent.Id)
+			f.tray.SetDifferentialParent(parent)
+		} else {
+			log.Infof("creating incremental backup on top of %s", parent.Id)
+			f.tray.SetParent(parent)
+		}
+		for path, fd := range parent.Files() {
+			stored[path] = fd.Hash
+			storedInfo[path] = fd.Info
+			storedLinks[path] = fd.LinkTo
+			if fd.Info == nil {
+				continue
+			}
+			sum, err := hex.DecodeString(fd.Hash)
+			if err != nil || len(sum) != sha512.Size {
+				continue
+			}
+			e := &indexer.Entry{Info: fd.Info}
+			copy(e.Sum[:], sum)
+			previous[path] = e
+		}
+		f.indexer.SetPrevious(previous)
+	}
+
 	// Index the filesystem.
 	files, err := f.indexer.Index()
 	if err != nil {
 		return err
 	}
 
-	// Map files into molecules.
-	mols := make(map[string]*molecule.Molecule)
-	for path, hash := range files {
-		mol, err := molecule.New(path, fmt.Sprintf("%x", hash), f.em)
+	// Map files into molecules, in path order so that the same tree is always
+	// packed the same way. Hard links only store the content once, with the
+	// file they link to.
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	links := f.indexer.Links()
+	var mols []*molecule.Molecule
+	for _, path := range paths {
+		hash := files[path]
+		sum := fmt.Sprintf("%x", hash)
+		linkTo := links[path]
+		// Skip files that have not changed since the parent backup.
+		if hash, ok := stored[path]; ok && hash == sum && storedLinks[path] == linkTo {
+			same, err := sameMetadata(path, storedInfo[path])
+			if err != nil {
+				return err
+			}
+			if same {
+				continue
+			}
+		}
+		var mol *molecule.Molecule
+		if linkTo != "" {
+			mol, err = molecule.NewLink(path, sum, linkTo)
+		} else {
+			mol, err = molecule.New(path, sum, f.em)
+		}
 		if err != nil {
 			return err
 		}
-		mols[path] = mol
+		mols = append(mols, mol)
 	}
 
 	// Populate the trays with molecules. This is where the actual file gets
 	// read from the filesystem and appeneded to the backing store.
 	for _, mol := range mols {
-		if _, err := f.tray.WriteMolecule(mol); err != nil {
+		if mol.LinkTo != "" {
+			_, err = f.tray.WriteLink(mol)
+		} else {
+			_, err = f.tray.WriteMolecule(mol)
+		}
+		if err != nil {
 			return err
 		}
 		if err := mol.Close(); err != nil {
@@ -87,6 +228,20 @@ func (f *Freezer) Freeze() error {
 		}
 	}
 
+	// Record files that were deleted since the parent backup.
+	var deleted []string
+	for path := range stored {
+		if _, ok := files[path]; !ok {
+			deleted = append(deleted, path)
+		}
+	}
+	sort.Strings(deleted)
+	for _, path := range deleted {
+		if err := f.tray.WriteTombstone(path); err != nil {
+			return err
+		}
+	}
+
 	// Close the last cube in the tray. The other cubes get closed in the
 	// process of writing out the molecules.
 	log.Debugf("closing current cube")
@@ -95,19 +250,23 @@ func (f *Freezer) Freeze() error {
 	}
 
 	// Write out tray metadata.
-	file, err := os.Create(path.Join(f.backupdir, fmt.Sprintf("tray-%s", f.tray.Id)))
-	if err != nil {
-		return err
+	return f.tray.Save()
+}
+
+// Check if the metadata that is restored with a file, its permissions,
+// ownership, modification time, extended attributes and ACLs, is the same as
+// the stored metadata.
+func sameMetadata(path string, stored *fileinfo.FileInfo) (bool, error) {
+	if stored == nil {
+		return false, nil
 	}
-	header, err := f.tray.Header()
+	info, err := fileinfo.Lstat(path)
 	if err != nil {
-		return err
-	}
-	if _, err := file.Write(header); err != nil {
-		return err
+		return false, err
 	}
-	if err := file.Close(); err != nil {
-		return err
-	}
-	return nil
+	return info.Mode == stored.Mode &&
+		info.Uid == stored.Uid &&
+		info.Gid == stored.Gid &&
+		info.ModTime.Equal(stored.ModTime) &&
+		info.SameXattrs(stored), nil
 }
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package freezer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+	"github.com/elliotpeele/deepfreeze/thawer"
+	"github.com/elliotpeele/deepfreeze/tray"
+)
+
+// Create the source tree, backup and keyring directories for a test below a
+// new tmp directory, which is returned for removal.
+func makeDirs(t *testing.T) (string, string, string, string) {
+	dir, err := ioutil.TempDir("", "testsuite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	backupdir := filepath.Join(dir, "backup")
+	keydir := filepath.Join(dir, "keys")
+	for _, p := range []string{root, backupdir, keydir} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, root, backupdir, keydir
+}
+
+// Write files below root, keyed by relative path.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Back up root into a new tray.
+func freezeRoot(t *testing.T, root string, backupdir string, keydir string, mode Mode) *tray.Tray {
+	f, err := New(root, backupdir, keydir, nil, nil, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	return f.tray
+}
+
+// Restore a backup of root into target and read back the content of the
+// restored files, keyed by path relative to target.
+func thawRoot(t *testing.T, trayId string, root string, backupdir string, keydir string, target string) map[string]string {
+	th, err := thawer.New(trayId, backupdir, keydir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Thaw(target, root); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	err = filepath.Walk(target, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(target, p)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// Check that the restored files are exactly the expected ones.
+func checkFiles(t *testing.T, restored map[string]string, expected map[string]string) {
+	if len(restored) != len(expected) {
+		t.Fatalf("expected %d files to be restored, found %d: %v", len(expected), len(restored), restored)
+	}
+	for name, content := range expected {
+		if restored[name] != content {
+			t.Fatalf("unexpected content restored for %s: %q", name, restored[name])
+		}
+	}
+}
+
+func TestFreezeIncremental(t *testing.T) {
+	dir, root, backupdir, keydir := makeDirs(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, root, map[string]string{
+		"a":     "alpha",
+		"sub/b": "bravo",
+		"sub/c": "charlie",
+	})
+	full := freezeRoot(t, root, backupdir, keydir, Full)
+	if !full.Full || full.ParentId != "" {
+		t.Fatalf("expected a full backup without a parent")
+	}
+	// Files are stored in path order.
+	var paths []string
+	for _, fd := range full.Cubes[0].Files {
+		paths = append(paths, fd.Path)
+	}
+	if !sort.StringsAreSorted(paths) {
+		t.Fatalf("expected files to be stored in path order: %v", paths)
+	}
+
+	writeFiles(t, root, map[string]string{"sub/b": "bravo changed"})
+	tr := freezeRoot(t, root, backupdir, keydir, Incremental)
+	if !tr.Incremental || tr.ParentId != full.Id {
+		t.Fatalf("expected an incremental backup on top of %s", full.Id)
+	}
+	changed := filepath.Join(root, "sub", "b")
+	var stored []string
+	for _, cd := range tr.Cubes {
+		for _, fd := range cd.Files {
+			stored = append(stored, fd.Path)
+		}
+	}
+	if len(stored) != 1 || stored[0] != changed {
+		t.Fatalf("expected only the changed file to be stored, found %v", stored)
+	}
+
+	// The newest version of every file is found through the chain.
+	files := tr.Files()
+	if files[changed].Id == full.Files()[changed].Id {
+		t.Fatalf("expected the new version of %s", changed)
+	}
+	unchanged := filepath.Join(root, "a")
+	if files[unchanged] == nil || files[unchanged].Id != full.Files()[unchanged].Id {
+		t.Fatalf("expected the parent version of %s", unchanged)
+	}
+
+	restored := thawRoot(t, tr.Id, root, backupdir, keydir, filepath.Join(dir, "restore"))
+	checkFiles(t, restored, map[string]string{
+		"a":     "alpha",
+		"sub/b": "bravo changed",
+		"sub/c": "charlie",
+	})
+}
+
+func TestFreezeMetadataChange(t *testing.T) {
+	dir, root, backupdir, keydir := makeDirs(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(root, "file")
+	writeFiles(t, root, map[string]string{"file": "content"})
+
+	freeze := func(mode Mode) *tray.Tray {
+		return freezeRoot(t, root, backupdir, keydir, mode)
+	}
+
+	freeze(Full)
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tr := freeze(Incremental)
+	if count := tr.FileCount(); count != 1 {
+		t.Fatalf("expected the file with changed permissions to be stored, found %d files", count)
+	}
+	fd, ok := tr.Files()[path]
+	if !ok || fd.Info == nil {
+		t.Fatalf("missing %s", path)
+	}
+	if perm := fd.Info.Mode.Perm(); perm != 0600 {
+		t.Fatalf("unexpected permissions stored for %s: %s", path, perm)
+	}
+
+	tr = freeze(Incremental)
+	if count := tr.FileCount(); count != 0 {
+		t.Fatalf("expected no files to be stored without changes, found %d files", count)
+	}
+
+	// Not every filesystem supports user extended attributes.
+	if err := fileinfo.SetXattr(path, "user.comment", []byte("changed")); err != nil {
+		t.Logf("skipping extended attribute change: %s", err)
+		return
+	}
+	tr = freeze(Incremental)
+	if count := tr.FileCount(); count != 1 {
+		t.Fatalf("expected the file with changed extended attributes to be stored, found %d files", count)
+	}
+	if value := tr.Files()[path].Info.Xattrs["user.comment"]; string(value) != "changed" {
+		t.Fatalf("unexpected extended attribute stored for %s: %q", path, value)
+	}
+}
+
+func TestFreezePointInTime(t *testing.T) {
+	dir, root, backupdir, keydir := makeDirs(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, root, map[string]string{"a": "first", "b": "bravo"})
+	first := freezeRoot(t, root, backupdir, keydir, Full)
+	writeFiles(t, root, map[string]string{"a": "second"})
+	second := freezeRoot(t, root, backupdir, keydir, Incremental)
+	writeFiles(t, root, map[string]string{"a": "third and last"})
+	freezeRoot(t, root, backupdir, keydir, Incremental)
+
+	found, err := tray.LatestBefore(backupdir, root, first.CreatedAt.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != nil {
+		t.Fatalf("expected no backup before the first one, found %s", found.Id)
+	}
+
+	// A point in time between two backups selects the older one, which is
+	// restored with the trays it builds on.
+	at := second.CreatedAt.Add(time.Nanosecond)
+	found, err = tray.LatestBefore(backupdir, root, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Id != second.Id {
+		t.Fatalf("expected %s to be selected at %s", second.Id, at)
+	}
+	restored := thawRoot(t, found.Id, root, backupdir, keydir, filepath.Join(dir, "restore"))
+	checkFiles(t, restored, map[string]string{
+		"a": "second",
+		"b": "bravo",
+	})
+}
+
+func TestFreezeTombstone(t *testing.T) {
+	dir, root, backupdir, keydir := makeDirs(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, root, map[string]string{"a": "alpha", "sub/b": "bravo"})
+	freezeRoot(t, root, backupdir, keydir, Full)
+	deleted := filepath.Join(root, "sub", "b")
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+	tr := freezeRoot(t, root, backupdir, keydir, Incremental)
+
+	var tombstone bool
+	for _, cd := range tr.Cubes {
+		for _, fd := range cd.Files {
+			if fd.Path == deleted {
+				tombstone = fd.Deleted
+			}
+		}
+	}
+	if !tombstone {
+		t.Fatalf("expected the deletion of %s to be recorded", deleted)
+	}
+	if _, ok := tr.Files()[deleted]; ok {
+		t.Fatalf("expected %s to be left out of the files in the tray", deleted)
+	}
+	restored := thawRoot(t, tr.Id, root, backupdir, keydir, filepath.Join(dir, "restore"))
+	checkFiles(t, restored, map[string]string{"a": "alpha"})
+
+	// A deleted file is only recorded once, and backed up again when it
+	// comes back.
+	tr = freezeRoot(t, root, backupdir, keydir, Incremental)
+	if count := tr.FileCount(); count != 0 {
+		t.Fatalf("expected no files to be stored without changes, found %d files", count)
+	}
+	writeFiles(t, root, map[string]string{"sub/b": "bravo again"})
+	tr = freezeRoot(t, root, backupdir, keydir, Incremental)
+	if fd, ok := tr.Files()[deleted]; !ok || fd.Deleted {
+		t.Fatalf("expected %s to be backed up again", deleted)
+	}
+	restored = thawRoot(t, tr.Id, root, backupdir, keydir, filepath.Join(dir, "restore-again"))
+	checkFiles(t, restored, map[string]string{"a": "alpha", "sub/b": "bravo again"})
+}
+
+func TestFreezeDifferential(t *testing.T) {
+	dir, root, backupdir, keydir := makeDirs(t)
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, root, map[string]string{"a": "alpha", "b": "bravo", "c": "charlie"})
+	full := freezeRoot(t, root, backupdir, keydir, Full)
+	writeFiles(t, root, map[string]string{"a": "alpha changed"})
+	freezeRoot(t, root, backupdir, keydir, Incremental)
+	writeFiles(t, root, map[string]string{"b": "bravo changed"})
+	tr := freezeRoot(t, root, backupdir, keydir, Differential)
+
+	// Everything that changed since the full backup is stored again,
+	// skipping the incremental backup in between.
+	if !tr.Differential || tr.ParentId != full.Id {
+		t.Fatalf("expected a differential backup on top of %s", full.Id)
+	}
+	stored := make(map[string]bool)
+	for _, cd := range tr.Cubes {
+		for _, fd := range cd.Files {
+			stored[filepath.Base(fd.Path)] = true
+		}
+	}
+	if len(stored) != 2 || !stored["a"] || !stored["b"] {
+		t.Fatalf("expected the files changed since the full backup to be stored, found %v", stored)
+	}
+
+	restored := thawRoot(t, tr.Id, root, backupdir, keydir, filepath.Join(dir, "restore"))
+	checkFiles(t, restored, map[string]string{
+		"a": "alpha changed",
+		"b": "bravo changed",
+		"c": "charlie",
+	})
+}
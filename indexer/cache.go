@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+	"github.com/elliotpeele/deepfreeze/log"
+	"github.com/elliotpeele/deepfreeze/utils"
+)
+
+// Persistent cache of file content hashes, kept on local disk between runs.
+// Each directory tree that is indexed gets its own cache file.
+type Cache struct {
+	path    string
+	entries map[string]*cacheEntry
+	seen    map[string]*cacheEntry
+	mtx     sync.Mutex
+}
+
+// A cached hash is only valid while the file keeps the same device, inode,
+// size and modification time.
+type cacheEntry struct {
+	Device  uint64    `json:"device"`
+	Inode   uint64    `json:"inode"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Sum     []byte    `json:"sum"`
+}
+
+// Open the hash cache for the directory tree at root, stored in dir. A
+// missing or unreadable cache file results in an empty cache.
+func OpenCache(dir string, root string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		path:    filepath.Join(dir, fmt.Sprintf("hashes-%x", sha1.Sum([]byte(abs)))),
+		entries: make(map[string]*cacheEntry),
+		seen:    make(map[string]*cacheEntry),
+	}
+	buf, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &c.entries); err != nil {
+		log.Warningf("ignoring corrupt hash cache %s: %s", c.path, err)
+		c.entries = make(map[string]*cacheEntry)
+	}
+	log.Debugf("loaded %d cached hashes from %s", len(c.entries), c.path)
+	return c, nil
+}
+
+// Create a cache entry from file info. Returns nil if the file can not be
+// identified reliably.
+func newCacheEntry(info *fileinfo.FileInfo) *cacheEntry {
+	if info.Inode == 0 {
+		return nil
+	}
+	return &cacheEntry{
+		Device:  info.Device,
+		Inode:   info.Inode,
+		Size:    info.Size,
+		ModTime: info.ModTime,
+	}
+}
+
+// Look up the hash of a file, returning false if it is not cached or the
+// file has changed since it was cached.
+func (c *Cache) Lookup(path string, info *fileinfo.FileInfo) ([sha512.Size]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[path]
+	cur := newCacheEntry(info)
+	if !ok || cur == nil ||
+		e.Device != cur.Device ||
+		e.Inode != cur.Inode ||
+		e.Size != cur.Size ||
+		!e.ModTime.Equal(cur.ModTime) ||
+		len(e.Sum) != sha512.Size {
+		return [sha512.Size]byte{}, false
+	}
+	var sum [sha512.Size]byte
+	copy(sum[:], e.Sum)
+	return sum, true
+}
+
+// Record the hash of a file.
+func (c *Cache) Store(path string, info *fileinfo.FileInfo, sum [sha512.Size]byte) {
+	e := newCacheEntry(info)
+	if e == nil {
+		return
+	}
+	e.Sum = sum[:]
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.seen[path] = e
+}
+
+// Write the hashes stored since the cache was opened, dropping files that
+// were not seen. The cache file is replaced atomically, so an interrupted
+// run leaves the previous cache in place.
+func (c *Cache) Save() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	buf, err := utils.ToJSON(c.seen)
+	if err != nil {
+		return err
+	}
+	tmpf, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpf.Name())
+	if _, err := tmpf.Write(buf); err != nil {
+		tmpf.Close()
+		return err
+	}
+	if err := tmpf.Sync(); err != nil {
+		tmpf.Close()
+		return err
+	}
+	if err := tmpf.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpf.Name(), c.path); err != nil {
+		return err
+	}
+	log.Debugf("saved %d cached hashes to %s", len(c.seen), c.path)
+	c.entries = c.seen
+	c.seen = make(map[string]*cacheEntry)
+	return nil
+}
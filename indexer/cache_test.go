@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testsuite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := &fileinfo.FileInfo{
+		Size:    11358,
+		ModTime: time.Unix(1500000000, 0),
+		Device:  2049,
+		Inode:   42,
+	}
+	sum := sha512.Sum512([]byte("foo"))
+
+	c, err := OpenCache(dir, "/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Store("/srv/foo", info, sum)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCache(dir, "/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, ok := c.Lookup("/srv/foo", info)
+	if !ok || cached != sum {
+		t.Fatal("expected cached hash")
+	}
+
+	changed := *info
+	changed.ModTime = changed.ModTime.Add(time.Second)
+	if _, ok := c.Lookup("/srv/foo", &changed); ok {
+		t.Fatal("unexpected cached hash for modified file")
+	}
+
+	other, err := OpenCache(dir, "/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Lookup("/srv/foo", info); ok {
+		t.Fatal("unexpected cached hash from another root")
+	}
+}
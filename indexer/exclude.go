@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Check if a path is excluded by a pattern. Patterns without a path
+// separator, such as "node_modules" or "*.tmp", match the last element of
+// the path. Other patterns are matched against the whole path if they
+// contain glob characters and otherwise exclude everything under the given
+// path.
+func matchExclude(pattern string, path string) (bool, error) {
+	pattern = filepath.Clean(pattern)
+	path = filepath.Clean(path)
+	if !strings.ContainsRune(pattern, filepath.Separator) {
+		return filepath.Match(pattern, filepath.Base(path))
+	}
+	if strings.ContainsAny(pattern, "*?[\\") {
+		return filepath.Match(pattern, path)
+	}
+	return path == pattern || strings.HasPrefix(path, pattern+string(filepath.Separator)), nil
+}
+
+// Check if a path is excluded by any of the patterns.
+func matchExcludes(patterns []string, path string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := matchExclude(pattern, path)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
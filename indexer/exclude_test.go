@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import "testing"
+
+func TestMatchExclude(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"node_modules", "src/app/node_modules", true},
+		{"node_modules", "src/app/node_modules.txt", false},
+		{"*.tmp", "src/sub/a.tmp", true},
+		{"/srv/cache", "/srv/cache", true},
+		{"/srv/cache", "/srv/cache/a/b", true},
+		{"/srv/cache", "/srv/cached", false},
+		{"/srv/cache/", "/srv/cache/a", true},
+		{"/srv/*/tmp", "/srv/app/tmp", true},
+		{"/srv/*/tmp", "/srv/app/data", false},
+	}
+	for _, test := range tests {
+		matched, err := matchExclude(test.pattern, test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != test.expected {
+			t.Fatalf("unexpected match of %s for %s: %v", test.pattern, test.path, matched)
+		}
+	}
+
+	if _, err := matchExclude("[", "foo"); err == nil {
+		t.Fatal("expected error for bad pattern")
+	}
+}
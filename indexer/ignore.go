@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A single pattern from an exclude file in gitignore syntax.
+type ignoreRule struct {
+	pattern string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Parse a line of an exclude file. Returns nil for blank lines and comments.
+//
+// The syntax follows gitignore: a leading "!" re-includes paths excluded by
+// earlier patterns, a trailing "/" only matches directories, and patterns
+// with a "/" anywhere but the end are anchored to the root of the tree.
+// Other patterns match at any depth. "*" and "?" do not match "/", while
+// "**" matches any number of directories.
+func parseIgnoreRule(line string) (*ignoreRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	r := &ignoreRule{pattern: line}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\") {
+		// Escaped leading "!" or "#".
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	expr := "^"
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		expr += "(?:.*/)?"
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		// "**" is only special as a whole path element.
+		doubleStar := strings.HasPrefix(line[i:], "**") && (i == 0 || line[i-1] == '/')
+		switch {
+		case doubleStar && strings.HasPrefix(line[i:], "**/"):
+			expr += "(?:.*/)?"
+			i += 2
+		case doubleStar && i+2 == len(line):
+			expr += ".*"
+			i++
+		case c == '*':
+			expr += "[^/]*"
+		case c == '?':
+			expr += "[^/]"
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in %q", r.pattern)
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + class + "]"
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			expr += regexp.QuoteMeta(string(line[i]))
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	expr += "$"
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %s", r.pattern, err)
+	}
+	r.re = re
+	return r, nil
+}
+
+// Check if a rule matches a slash separated path relative to the root of the
+// tree.
+func (r *ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return r.re.MatchString(rel)
+}
+
+// Files that mark a directory as not to be backed up.
+var DefaultMarkers = []string{".deepfreeze-ignore", "CACHEDIR.TAG"}
+
+// Signature that a CACHEDIR.TAG file must start with to be recognized, see
+// https://bford.info/cachedir/.
+const cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// Rules deciding which paths are skipped while walking a directory tree.
+type Filter struct {
+	excludes []string
+	rules    []*ignoreRule
+	markers  []string
+}
+
+// Create a filter from exclude patterns as given on the command line. The
+// default marker files are honored.
+func NewFilter(excludes []string) *Filter {
+	return &Filter{
+		excludes: excludes,
+		markers:  DefaultMarkers,
+	}
+}
+
+// Read exclude rules in gitignore syntax from a file. Rules are evaluated in
+// the order they are loaded, the last matching rule wins.
+func (f *Filter) LoadExcludeFile(path string) error {
+	fobj, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fobj.Close()
+
+	scanner := bufio.NewScanner(fobj)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		r, err := parseIgnoreRule(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineno, err)
+		}
+		if r != nil {
+			f.rules = append(f.rules, r)
+		}
+	}
+	return scanner.Err()
+}
+
+// Check if a path found while walking the tree at root should be skipped.
+// Paths matching an exclude pattern are always skipped, while exclude file
+// rules may re-include paths. Directories holding a marker file are skipped
+// as well.
+func (f *Filter) Excluded(root string, path string, info os.FileInfo) (bool, error) {
+	matched, err := matchExcludes(f.excludes, path)
+	if err != nil || matched {
+		return matched, err
+	}
+
+	if len(f.rules) > 0 {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return false, err
+		}
+		rel = filepath.ToSlash(rel)
+		excluded := false
+		for _, r := range f.rules {
+			if r.match(rel, info.IsDir()) {
+				excluded = !r.negate
+			}
+		}
+		if excluded {
+			return true, nil
+		}
+	}
+
+	if info.IsDir() {
+		return f.hasMarker(path)
+	}
+	return false, nil
+}
+
+// Check if a directory holds one of the marker files.
+func (f *Filter) hasMarker(dir string) (bool, error) {
+	for _, marker := range f.markers {
+		p := filepath.Join(dir, marker)
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if marker != "CACHEDIR.TAG" {
+			return true, nil
+		}
+		// Only cache directories with a valid tag are skipped.
+		tagged, err := hasCacheDirSignature(p)
+		if err != nil || tagged {
+			return tagged, err
+		}
+	}
+	return false, nil
+}
+
+// Check if a file starts with the cache directory tag signature.
+func hasCacheDirSignature(path string) (bool, error) {
+	fobj, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fobj.Close()
+	buf := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(fobj, buf); err != nil {
+		return false, nil
+	}
+	return string(buf) == cacheDirSignature, nil
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreRule(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"*.log", "app.log", false, true},
+		{"*.log", "var/app.log", false, true},
+		{"*.log", "var/app.log/x", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/server/arch.txt", false, false},
+		{"doc/**/*.txt", "doc/server/arch.txt", false, true},
+		{"doc/**/*.txt", "doc/notes.txt", false, true},
+		{"**/cache", "a/b/cache", true, true},
+		{"logs/**", "logs/2017/01/app.log", false, true},
+		{"tmp/", "src/tmp", true, true},
+		{"tmp/", "src/tmp", false, false},
+		{"file[0-9].txt", "file1.txt", false, true},
+		{"file[!0-9].txt", "file1.txt", false, false},
+		{"\\#notes", "#notes", false, true},
+	}
+	for _, test := range tests {
+		r, err := parseIgnoreRule(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched := r.match(test.path, test.isDir); matched != test.expected {
+			t.Fatalf("unexpected match of %s for %s: %v", test.pattern, test.path, matched)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		r, err := parseIgnoreRule(line)
+		if err != nil || r != nil {
+			t.Fatalf("expected %q to be skipped", line)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "testsuite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	write := func(name string, content string) {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("rules", "*.log\n!keep.log\n")
+	write("app.log", "")
+	write("keep.log", "")
+	write("skipped/.deepfreeze-ignore", "")
+	write("cache/CACHEDIR.TAG", cacheDirSignature+"\n")
+	write("untagged/CACHEDIR.TAG", "not a cache\n")
+
+	f := NewFilter(nil)
+	if err := f.LoadExcludeFile(filepath.Join(root, "rules")); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"app.log":  true,
+		"keep.log": false,
+		"skipped":  true,
+		"cache":    true,
+		"untagged": false,
+	}
+	for name, expected := range tests {
+		p := filepath.Join(root, name)
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		excluded, err := f.Excluded(root, p, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if excluded != expected {
+			t.Fatalf("unexpected result for %s: %v", name, excluded)
+		}
+	}
+}
@@ -18,26 +18,131 @@ package indexer
 
 import (
 	"crypto/sha512"
+	"runtime"
 
+	"github.com/elliotpeele/deepfreeze/fileinfo"
 	"github.com/elliotpeele/deepfreeze/log"
 )
 
 // File system indexer.
 type Indexer struct {
-	excludes []string
-	root     string
+	filter      *Filter
+	root        string
+	previous    map[string]*Entry
+	cache       *Cache
+	rehashAll   bool
+	digesters   int
+	maxInFlight int64
+	links       map[string]string
 }
 
-// Create a new indexer instance.
+// Default limit on the file data held in memory while hashing.
+const DefaultMaxInFlight = 64 * 1024 * 1024
+
+// A file recorded by an earlier index, such as the parent backup.
+type Entry struct {
+	Sum  [sha512.Size]byte
+	Info *fileinfo.FileInfo
+}
+
+// Create a new indexer instance. Paths matching one of the exclude patterns
+// and directories holding one of the default marker files are skipped.
 func New(root string, excludes []string) *Indexer {
 	return &Indexer{
-		root:     root,
-		excludes: excludes,
+		root:   root,
+		filter: NewFilter(excludes),
 	}
 }
 
+// Read additional exclude rules in gitignore syntax from a file.
+func (idx *Indexer) LoadExcludeFile(path string) error {
+	return idx.filter.LoadExcludeFile(path)
+}
+
+// Set the files recorded by an earlier index. Files whose size, modification
+// time, inode and change time have not changed since are assumed to have the
+// same content and are not hashed again.
+func (idx *Indexer) SetPrevious(previous map[string]*Entry) {
+	idx.previous = previous
+}
+
+// Set the persistent hash cache to consult before reading files. Hashes
+// computed while indexing are stored in the cache.
+func (idx *Indexer) SetCache(cache *Cache) {
+	idx.cache = cache
+}
+
+// Hash every file, even if it looks unchanged since the previous index or
+// its hash is cached.
+func (idx *Indexer) SetRehashAll(rehashAll bool) {
+	idx.rehashAll = rehashAll
+}
+
+// Limit the number of files hashed at once and the total size of the read
+// buffers used for hashing. Zero selects the default: two digesters per
+// available os thread and DefaultMaxInFlight bytes.
+func (idx *Indexer) SetLimits(digesters int, maxInFlight int64) {
+	idx.digesters = digesters
+	idx.maxInFlight = maxInFlight
+}
+
+// Get the number of digesters and in flight bytes to use, applying the
+// defaults. The indexer may be nil.
+func (idx *Indexer) limits() (int, int64) {
+	// Use two times the number of available os threads.
+	digesters := runtime.GOMAXPROCS(-1) * 2
+	maxInFlight := int64(DefaultMaxInFlight)
+	if idx != nil && idx.digesters > 0 {
+		digesters = idx.digesters
+	}
+	if idx != nil && idx.maxInFlight > 0 {
+		maxInFlight = idx.maxInFlight
+	}
+	return digesters, maxInFlight
+}
+
 // Index filesystem with content hashes.
 func (idx *Indexer) Index() (map[string][sha512.Size]byte, error) {
 	log.Infof("indexing directory tree")
-	return HashAll(idx.root)
+	files, links, err := hashAll(idx.root, idx.filter, idx)
+	if err != nil {
+		return nil, err
+	}
+	idx.links = links
+	if idx.cache != nil {
+		if err := idx.cache.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Get the hard links found by the last index, as a map from the path of each
+// link to the path of the first file found with the same device and inode.
+// Hard links are included in the index with the hash of that file.
+func (idx *Indexer) Links() map[string]string {
+	return idx.links
+}
+
+// Find the known hash of a file, either from the previous index or the
+// cache.
+func (idx *Indexer) lookup(path string, info *fileinfo.FileInfo) ([sha512.Size]byte, bool) {
+	if idx == nil || idx.rehashAll {
+		return [sha512.Size]byte{}, false
+	}
+	if e, ok := idx.previous[path]; ok && e.Info.Matches(info) {
+		return e.Sum, true
+	}
+	if idx.cache != nil {
+		return idx.cache.Lookup(path, info)
+	}
+	return [sha512.Size]byte{}, false
+}
+
+// Record the hash of a file in the cache.
+func (idx *Indexer) store(path string, info *fileinfo.FileInfo, sum [sha512.Size]byte) {
+	if idx == nil || idx.cache == nil {
+		return
+	}
+	idx.cache.Store(path, info, sum)
 }
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+)
+
+func TestIndexerPrevious(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testsuite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fileinfo.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A hash that does not match the content shows when the file was not
+	// read again.
+	stale := sha512.Sum512([]byte("stale"))
+	index := func(rehashAll bool) [sha512.Size]byte {
+		idx := New(dir, nil)
+		idx.SetPrevious(map[string]*Entry{
+			path: {Sum: stale, Info: info},
+		})
+		idx.SetRehashAll(rehashAll)
+		files, err := idx.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files[path]
+	}
+
+	if sum := index(false); sum != stale {
+		t.Fatal("expected the unchanged file to be skipped")
+	}
+	if sum := index(true); sum != sha512.Sum512([]byte("foo")) {
+		t.Fatal("expected every file to be hashed")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sum := index(false); sum != sha512.Sum512([]byte("changed")) {
+		t.Fatal("expected the changed file to be hashed")
+	}
+}
@@ -21,82 +21,232 @@ package indexer
 import (
 	"crypto/sha512"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sync"
 
+	"github.com/elliotpeele/deepfreeze/fileinfo"
 	"github.com/elliotpeele/deepfreeze/log"
 )
 
+// A file is an entry found while walking the directory tree.
+type file struct {
+	path string
+	info os.FileInfo
+}
+
 // walkFiles starts a goroutine to walk the directory tree at root and send the
-// path of each regular file on the string channel.  It sends the result of the
-// walk on the error channel.  If done is closed, walkFiles abandons its work.
-func walkFiles(done <-chan struct{}, root string) (<-chan string, <-chan error) {
-	paths := make(chan string)
+// path and info of each directory, regular file, symlink, named pipe and
+// device on the file channel.  Sockets can not be backed up and are skipped.
+// Regular files that are hard links to a file already found are not sent,
+// instead they are recorded in links, mapping the path to the first path
+// found for the same device and inode.  Paths excluded by the filter are
+// skipped, including everything below excluded directories.  The filter may
+// be nil.  It sends the result of the walk on the error channel.  If done is
+// closed, walkFiles abandons its work.
+func walkFiles(done <-chan struct{}, root string, filter *Filter, links map[string]string) (<-chan file, <-chan error) {
+	files := make(chan file)
 	errc := make(chan error, 1)
 	go func() {
-		// Close the paths channel after Walk returns.
-		defer close(paths)
-		// No select needed for this send, since errc is buffered.
-		errc <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		// Close the files channel after Walk returns.
+		defer close(files)
+		excluded := 0
+		// First path found for each device and inode with more than one
+		// link.
+		inodes := make(map[[2]uint64]string)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if !info.Mode().IsRegular() {
+			if path != root && filter != nil {
+				matched, err := filter.Excluded(root, path, info)
+				if err != nil {
+					return err
+				}
+				if matched {
+					log.Debugf("excluding %s", path)
+					excluded++
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+			if info.Mode()&(os.ModeSocket|os.ModeIrregular) != 0 {
+				log.Debugf("skipping %s", path)
 				return nil
 			}
+			if info.Mode().IsRegular() {
+				fi := fileinfo.NewFileInfo(info)
+				key := [2]uint64{fi.Device, fi.Inode}
+				if fi.Nlink > 1 && fi.Inode != 0 {
+					if first, ok := inodes[key]; ok {
+						log.Debugf("%s is a hard link to %s", path, first)
+						links[path] = first
+						return nil
+					}
+					inodes[key] = path
+				}
+			}
 			select {
-			case paths <- path:
+			case files <- file{path, info}:
 			case <-done:
 				return errors.New("walk canceled")
 			}
 			return nil
 		})
+		if filter != nil {
+			log.Infof("excluded %d paths", excluded)
+		}
+		// No select needed for this send, since errc is buffered.
+		errc <- err
 	}()
-	return paths, errc
+	return files, errc
 }
 
-// A result is the product of reading and summing a file using MD5.
+// A result is the product of reading and summing a file using SHA512.
 type result struct {
-	path string
-	sum  [sha512.Size]byte
-	err  error
+	path   string
+	sum    [sha512.Size]byte
+	reused bool
+	err    error
+}
+
+// Size of the buffers used to read files while hashing them.
+const bufferSize = 1024 * 1024
+
+// A bufferPool hands out a bounded number of read buffers, which limits the
+// amount of file data held in memory by all digesters together. Buffers are
+// allocated on first use.
+type bufferPool struct {
+	buffers chan []byte
+	size    int64
+}
+
+// newBufferPool creates a pool of buffers holding at most maxBytes in total.
+// There is always at least one buffer.
+func newBufferPool(maxBytes int64) *bufferPool {
+	size := int64(bufferSize)
+	if maxBytes < size {
+		size = maxBytes
+	}
+	if size < 4096 {
+		size = 4096
+	}
+	count := maxBytes / size
+	if count < 1 {
+		count = 1
+	}
+	pool := &bufferPool{
+		buffers: make(chan []byte, count),
+		size:    size,
+	}
+	for i := int64(0); i < count; i++ {
+		pool.buffers <- nil
+	}
+	return pool
 }
 
-// digester reads path names from paths and sends digests of the corresponding
-// files on c until either paths or done is closed.
-func digester(done <-chan struct{}, paths <-chan string, c chan<- result) {
-	for path := range paths {
-		log.Debugf("indexing %s", path)
-		data, err := ioutil.ReadFile(path)
+// hashFile computes the SHA512 sum of a file, streaming it through a buffer
+// from the pool. It blocks until a buffer is available.
+func (pool *bufferPool) hashFile(path string) ([sha512.Size]byte, error) {
+	var sum [sha512.Size]byte
+	fobj, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer fobj.Close()
+
+	buf := <-pool.buffers
+	if buf == nil {
+		buf = make([]byte, pool.size)
+	}
+	defer func() { pool.buffers <- buf }()
+
+	h := sha512.New()
+	// Hide any WriterTo implementation of the file so that the copy goes
+	// through the pooled buffer.
+	if _, err := io.CopyBuffer(h, struct{ io.Reader }{fobj}, buf); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// digester reads files from files and sends digests of the corresponding
+// files on c until either files or done is closed. Files with a digest known
+// to idx are not read.
+func digester(done <-chan struct{}, files <-chan file, idx *Indexer, pool *bufferPool, c chan<- result) {
+	for f := range files {
+		info := fileinfo.NewFileInfo(f.info)
+		r := result{path: f.path}
+		if !f.info.Mode().IsRegular() {
+			// Other entries have no content, describe them instead.
+			info, err := fileinfo.Lstat(f.path)
+			if err == nil {
+				r.sum = HashSpecial(info)
+			}
+			r.err = err
+		} else if sum, ok := idx.lookup(f.path, info); ok {
+			log.Debugf("unchanged %s", f.path)
+			r.sum = sum
+			r.reused = true
+		} else {
+			log.Debugf("indexing %s", f.path)
+			r.sum, r.err = pool.hashFile(f.path)
+		}
+		if r.err == nil && f.info.Mode().IsRegular() {
+			idx.store(f.path, info, r.sum)
+		}
 		select {
-		case c <- result{path, sha512.Sum512(data), err}:
+		case c <- r:
 		case <-done:
 			return
 		}
 	}
 }
 
+// HashSpecial computes the SHA512 sum of a description of an entry that is
+// not a regular file, such as a directory, symlink or device. The sum changes
+// when the type of the entry, the target of a symlink or the numbers of a
+// device change. Permissions, ownership and times are not part of the sum.
+func HashSpecial(info *fileinfo.FileInfo) [sha512.Size]byte {
+	desc := fmt.Sprintf("%s %s %d %d", info.Mode&os.ModeType, info.LinkTarget, info.DevMajor, info.DevMinor)
+	return sha512.Sum512([]byte(desc))
+}
+
 // HashAll reads all the files in the file tree rooted at root and returns a map
-// from file path to the SHA512 sum of the file's contents.  If the directory walk
+// from file path to the SHA512 sum of the file's contents.  Entries that are
+// not regular files are summed with HashSpecial.  If the directory walk
 // fails or any read operation fails, HashAll returns an error.  In that case,
 // HashAll does not wait for inflight read operations to complete.
 func HashAll(root string) (map[string][sha512.Size]byte, error) {
+	m, _, err := hashAll(root, nil, nil)
+	return m, err
+}
+
+// hashAll is HashAll, but paths excluded by the filter are skipped and files
+// whose digest is already known to idx are not read again. Hard links are
+// only read once, they are returned as a map from the path of each link to
+// the path it links to. The filter and indexer may be nil.
+func hashAll(root string, filter *Filter, idx *Indexer) (map[string][sha512.Size]byte, map[string]string, error) {
 	done := make(chan struct{})
 	defer close(done)
 
-	paths, errc := walkFiles(done, root)
+	links := make(map[string]string)
+	files, errc := walkFiles(done, root, filter, links)
+
+	numDigesters, maxInFlight := idx.limits()
+	pool := newBufferPool(maxInFlight)
 
 	c := make(chan result)
 	var wg sync.WaitGroup
-	// Use two times the number of available os threads.
-	numDigesters := runtime.GOMAXPROCS(-1) * 2
 	wg.Add(numDigesters)
 	for i := 0; i < numDigesters; i++ {
 		go func() {
-			digester(done, paths, c)
+			digester(done, files, idx, pool, c)
 			wg.Done()
 		}()
 	}
@@ -106,15 +256,29 @@ func HashAll(root string) (map[string][sha512.Size]byte, error) {
 	}()
 
 	m := make(map[string][sha512.Size]byte)
+	reused := 0
 	for r := range c {
 		if r.err != nil {
-			return nil, r.err
+			return nil, nil, r.err
 		}
 		m[r.path] = r.sum
+		if r.reused {
+			reused++
+		}
 	}
 	// Check whether the Walk failed.
 	if err := <-errc; err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if idx != nil {
+		log.Infof("hashed %d files, %d unchanged files skipped", len(m)-reused, reused)
+	}
+	// Hard links have the content of the file they link to.
+	for path, first := range links {
+		m[path] = m[first]
+	}
+	if len(links) > 0 {
+		log.Infof("found %d hard links", len(links))
 	}
-	return m, nil
+	return m, links, nil
 }
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package indexer
+
+import (
+	"crypto/sha512"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashAll(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sha512.Sum512(data)
+
+	// A single small buffer forces the file to be hashed in several reads.
+	idx := New("../testdata", nil)
+	idx.SetLimits(1, 4096)
+	sums, _, err := hashAll("../testdata", nil, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums["../testdata/foo"] != expected {
+		t.Fatal("streamed hash does not match")
+	}
+
+	sums, err = HashAll("../testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums["../testdata/foo"] != expected {
+		t.Fatal("hash does not match")
+	}
+}
+
+func TestHashAllLinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "testsuite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	a := filepath.Join(root, "a")
+	b := filepath.Join(root, "b")
+	c := filepath.Join(root, "c")
+	if err := ioutil.WriteFile(a, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sums, links, err := hashAll(root, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[b] != a {
+		t.Fatalf("unexpected links: %v", links)
+	}
+	if sums[b] != sums[a] || sums[c] != sums[a] {
+		t.Fatal("expected links to have the hash of the linked file")
+	}
+}
@@ -18,6 +18,9 @@ package molecule
 
 import (
 	"compress/gzip"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -25,6 +28,7 @@ import (
 
 	"github.com/elliotpeele/deepfreeze/atom"
 	"github.com/elliotpeele/deepfreeze/encrypt"
+	"github.com/elliotpeele/deepfreeze/fileinfo"
 	"github.com/elliotpeele/deepfreeze/log"
 	"github.com/elliotpeele/deepfreeze/utils"
 	"github.com/satori/go.uuid"
@@ -39,35 +43,104 @@ type Molecule struct {
 	Atoms        []*atom.Atom `json:"-"`
 	CreatedAt    time.Time    `json:"created_at"`
 	OriginalSize int64        `json:"size"`
+	LinkTo       string       `json:"link_to,omitempty"`
 
 	cur_size        int64
 	orig_info       os.FileInfo
 	cur_info        os.FileInfo
 	fobj            *os.File
 	read_size       int64
+	write_size      int64
 	delete_on_close bool
 	em              *encrypt.EncryptionManager
 }
 
-// Create a new molecule.
+// Create a new molecule. Symlinks are not followed. Directories, symlinks and
+// special files are stored without content, their file info holds everything
+// needed to recreate them.
 func New(path string, hash string, em *encrypt.EncryptionManager) (*Molecule, error) {
-	info, err := os.Stat(path)
+	fi, err := fileinfo.Lstat(path)
 	if err != nil {
 		return nil, err
 	}
+	info := fi.FileInfo()
+	cur := info
+	size := info.Size()
+	if !info.Mode().IsRegular() {
+		size = 0
+		// There is no content to store.
+		empty := &fileinfo.FileInfo{
+			Name: fi.Name,
+		}
+		cur = empty.FileInfo()
+	}
 	return &Molecule{
 		Id:              uuid.NewV4().String(),
 		Path:            path,
 		Hash:            hash,
 		CreatedAt:       time.Now(),
-		OriginalSize:    info.Size(),
+		OriginalSize:    size,
 		orig_info:       info,
-		cur_info:        info,
+		cur_info:        cur,
 		delete_on_close: false,
 		em:              em,
 	}, nil
 }
 
+// Create a new molecule for a hard link to the file at linkTo. The content is
+// only stored with the molecule of the linked file, the size is that of the
+// shared content.
+func NewLink(path string, hash string, linkTo string) (*Molecule, error) {
+	fi, err := fileinfo.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	// There is no content to store.
+	empty := &fileinfo.FileInfo{
+		Name: fi.Name,
+	}
+	return &Molecule{
+		Id:           uuid.NewV4().String(),
+		Path:         path,
+		Hash:         hash,
+		CreatedAt:    time.Now(),
+		OriginalSize: fi.Size,
+		LinkTo:       linkTo,
+		orig_info:    fi.FileInfo(),
+		cur_info:     empty.FileInfo(),
+	}, nil
+}
+
+// Create a new tombstone molecule to record that a file was deleted.
+func NewTombstone(path string) *Molecule {
+	return &Molecule{
+		Id:        uuid.NewV4().String(),
+		Path:      path,
+		CreatedAt: time.Now(),
+	}
+}
+
+// Check if the molecule is a tombstone for a deleted file.
+func (m *Molecule) IsDeleted() bool {
+	for _, a := range m.Atoms {
+		if a.Delete {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a serialized molecule header for restoring.
+func ParseMolecule(buf []byte, em *encrypt.EncryptionManager) (*Molecule, error) {
+	m := &Molecule{
+		em: em,
+	}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Open the file to be backed up.
 func (m *Molecule) Open() error {
 	log.Debugf("opening %s", m.Path)
@@ -86,13 +159,49 @@ func (m *Molecule) Read(p []byte) (n int, err error) {
 	return
 }
 
+// Create a temporary backing file to collect atom content for restoring.
+func (m *Molecule) Create() error {
+	f, err := ioutil.TempFile("", "deepfreeze")
+	if err != nil {
+		return err
+	}
+	m.fobj = f
+	m.delete_on_close = true
+	return nil
+}
+
+// Write atom content to the backing file.
+func (m *Molecule) Write(p []byte) (n int, err error) {
+	n, err = m.fobj.Write(p)
+	m.write_size += int64(n)
+	return
+}
+
+// Check if all of the atoms for the backing file have been written.
+func (m *Molecule) IsComplete() bool {
+	return m.cur_info != nil && m.write_size >= m.cur_info.Size()
+}
+
 // Seek the backup file.
 func (m *Molecule) Seek(offset int64, whence int) (int64, error) {
 	return m.fobj.Seek(offset, whence)
 }
 
+// Rewind the backing file so that its content can be read again.
+func (m *Molecule) Rewind() error {
+	if _, err := m.fobj.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	m.read_size = 0
+	return nil
+}
+
 // Close the backup file.
 func (m *Molecule) Close() error {
+	// Molecules without content, such as hard links, have no backing file.
+	if m.fobj == nil {
+		return nil
+	}
 	if err := m.fobj.Close(); err != nil {
 		return err
 	}
@@ -120,11 +229,22 @@ func (m *Molecule) Info() os.FileInfo {
 	return m.cur_info
 }
 
+// Set the current file info.
+func (m *Molecule) SetInfo(info os.FileInfo) {
+	m.cur_info = info
+	m.cur_size = info.Size()
+}
+
 // Get the original file info.
 func (m *Molecule) OrigInfo() os.FileInfo {
 	return m.orig_info
 }
 
+// Set the original file info.
+func (m *Molecule) SetOrigInfo(info os.FileInfo) {
+	m.orig_info = info
+}
+
 // Serialize the molecule header.
 func (m *Molecule) Header() ([]byte, error) {
 	return utils.ToJSON(m)
@@ -133,10 +253,27 @@ func (m *Molecule) Header() ([]byte, error) {
 // Create a new atom instance.
 func (m *Molecule) NewAtom(cubeId string, size int64) *atom.Atom {
 	a := atom.New(m.Id, cubeId, size)
+	a.PartId = int64(len(m.Atoms))
 	m.Atoms = append(m.Atoms, a)
 	return a
 }
 
+// Hash the next size bytes of the backing file without consuming them.
+func (m *Molecule) PeekHash(size int64) (string, error) {
+	offset, err := m.fobj.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := sha512.New()
+	if _, err := io.CopyN(h, m.fobj, size); err != nil {
+		return "", err
+	}
+	if _, err := m.fobj.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
 // Encrypt the file contents.
 func (m *Molecule) Encrypt() error {
 	log.Debugf("encrypting %s", m.Path)
@@ -149,73 +286,135 @@ func (m *Molecule) Encrypt() error {
 	if err != nil {
 		return err
 	}
-	// Compress orignal file.
-	w, err := m.em.Encrypt(m.fobj)
+	// Encrypt compressed file.
+	w, err := m.em.Encrypt(tmpf)
+	if err == nil {
+		_, err = io.Copy(w, m.fobj)
+		// Flush the encrypter once complete.
+		if err == nil {
+			err = w.Close()
+		}
+	}
 	if err != nil {
+		discard(tmpf)
 		return err
 	}
-	if _, err := io.Copy(w, m.fobj); err != nil {
+	return m.replaceBacking(tmpf)
+}
+
+// Compress file contents.
+func (m *Molecule) Compress() error {
+	log.Debugf("compressing %s", m.Path)
+	// Get a tmp file to compress into.
+	tmpf, err := ioutil.TempFile("", "deepfreeze")
+	if err != nil {
 		return err
 	}
-	// Flush the compressor once complete.
-	if err := w.Close(); err != nil {
-		return err
+	// Compress orignal file.
+	w, err := gzip.NewWriterLevel(tmpf, gzip.BestSpeed)
+	if err == nil {
+		_, err = io.Copy(w, m.fobj)
+		// Flush the compressor once complete.
+		if err == nil {
+			err = w.Close()
+		}
 	}
-	// Rewind tmp file.
-	if _, err := tmpf.Seek(0, 0); err != nil {
+	if err != nil {
+		discard(tmpf)
 		return err
 	}
-	// Check and store size.
-	info, err := tmpf.Stat()
+	return m.replaceBacking(tmpf)
+}
+
+// Decrypt the backing file contents.
+func (m *Molecule) Decrypt() error {
+	log.Debugf("decrypting %s", m.Path)
+	if m.em == nil {
+		log.Warnf("encryption system not initialized, skipping %s", m.Path)
+		return nil
+	}
+	// Get a tmp file to decrypt into.
+	tmpf, err := ioutil.TempFile("", "deepfreeze")
 	if err != nil {
 		return err
 	}
-	m.cur_size = info.Size()
-	m.cur_info = info
-	// Close underlying file object.
-	m.fobj.Close()
-	// Remove if marked.
-	if err := m.removeIfMarked(); err != nil {
+	// Decrypt backing file.
+	r, err := m.em.Decrypt(m.fobj)
+	if err == nil {
+		_, err = io.Copy(tmpf, r)
+	}
+	if err != nil {
+		discard(tmpf)
 		return err
 	}
-	// Replace with tmp file.
-	m.fobj = tmpf
-	// Mark tmp file for deletion.
-	m.delete_on_close = true
-	return nil
+	return m.replaceBacking(tmpf)
 }
 
-// Compress file contents.
-func (m *Molecule) Compress() error {
-	log.Debugf("compressing %s", m.Path)
-	// Get a tmp file to compress into.
+// Decompress the backing file contents.
+func (m *Molecule) Decompress() error {
+	log.Debugf("decompressing %s", m.Path)
+	// Get a tmp file to decompress into.
 	tmpf, err := ioutil.TempFile("", "deepfreeze")
 	if err != nil {
 		return err
 	}
-	// Compress orignal file.
-	w, err := gzip.NewWriterLevel(tmpf, gzip.BestSpeed)
+	// Decompress backing file.
+	r, err := gzip.NewReader(m.fobj)
+	if err == nil {
+		_, err = io.Copy(tmpf, r)
+		if err == nil {
+			err = r.Close()
+		}
+	}
 	if err != nil {
+		discard(tmpf)
 		return err
 	}
-	if _, err := io.Copy(w, m.fobj); err != nil {
-		return err
+	return m.replaceBacking(tmpf)
+}
+
+// Get a reader for the decrypted and decompressed backing file contents.
+// Nothing is written to disk, errors in the stored data are returned while
+// reading.
+func (m *Molecule) Unpack() (io.Reader, error) {
+	log.Debugf("unpacking %s", m.Path)
+	var r io.Reader = m.fobj
+	if m.em == nil {
+		log.Warnf("encryption system not initialized, skipping %s", m.Path)
+	} else {
+		dr, err := m.em.Decrypt(r)
+		if err != nil {
+			return nil, err
+		}
+		r = dr
 	}
-	// Flush the compressor once complete.
-	if err := w.Close(); err != nil {
-		return err
+	return gzip.NewReader(r)
+}
+
+// Close and remove a tmp file that is no longer needed.
+func discard(tmpf *os.File) {
+	tmpf.Close()
+	if err := os.Remove(tmpf.Name()); err != nil {
+		log.Warnf("unable to remove %s: %s", tmpf.Name(), err)
 	}
+}
+
+// Replace the backing file with a fully written tmp file.
+func (m *Molecule) replaceBacking(tmpf *os.File) error {
 	// Rewind tmp file.
 	if _, err := tmpf.Seek(0, 0); err != nil {
+		discard(tmpf)
 		return err
 	}
 	// Check and store size.
 	info, err := tmpf.Stat()
 	if err != nil {
+		discard(tmpf)
 		return err
 	}
 	m.cur_size = info.Size()
 	m.cur_info = info
+	m.read_size = 0
 	// Close underlying file object.
 	m.fobj.Close()
 	// Remove if marked.
@@ -20,7 +20,7 @@ import "testing"
 
 func TestMoleculeCompress(t *testing.T) {
 	m, err := New("../testdata/foo",
-		"84e99c21df3d69d6bcb82420dc1c5ab9e877aa19ca516fa2644cd2f1e6c35840")
+		"84e99c21df3d69d6bcb82420dc1c5ab9e877aa19ca516fa2644cd2f1e6c35840", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -24,6 +24,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/elliotpeele/deepfreeze/fileinfo"
 )
 
 var (
@@ -34,7 +36,7 @@ var (
 // Interface for storing archive metadata.
 type MetadataStore interface {
 	WriteMetadata(name string, data []byte) (n int, err error)
-	ReadMetadata() (md *metadataRecord, err error)
+	ReadMetadata() (md *MetadataRecord, err error)
 }
 
 // Interface for reading tarfiles.
@@ -53,17 +55,29 @@ type FileReadWriter interface {
 	FileWriter
 }
 
-// Private structure for storing record metadata.
-type metadataRecord struct {
+// Interface for archives that can store hard links.
+type LinkWriter interface {
+	WriteLink(info os.FileInfo, target string) error
+}
+
+// Interface for writing archives that need to be finalized.
+type ArchiveWriter interface {
+	FileWriter
+	Close() error
+}
+
+// Structure for storing record metadata.
+type MetadataRecord struct {
 	Name string
 	Data []byte
 }
 
 // High level structure for handling tarfiles.
 type TarFile struct {
-	w    *tar.Writer
-	r    *tar.Reader
-	size int64
+	w      *tar.Writer
+	r      *tar.Reader
+	size   int64
+	format tar.Format
 }
 
 // Create a new tar file for writing.
@@ -75,6 +89,13 @@ func New(w io.Writer) *TarFile {
 	}
 }
 
+// Create a new tar file for writing file headers in a specific format.
+func NewFormat(w io.Writer, format tar.Format) *TarFile {
+	tf := New(w)
+	tf.format = format
+	return tf
+}
+
 // Open a tar file for reading
 func Open(r io.Reader) *TarFile {
 	return &TarFile{
@@ -129,11 +150,10 @@ func (tf *TarFile) WriteFile(info os.FileInfo, r io.Reader) (n int, err error) {
 		return 0, writeError
 	}
 
-	header, err := tar.FileInfoHeader(info, "")
+	header, err := tf.fileHeader(info)
 	if err != nil {
 		return 0, err
 	}
-
 	if err := tf.w.WriteHeader(header); err != nil {
 		return 0, err
 	}
@@ -148,8 +168,57 @@ func (tf *TarFile) WriteFile(info os.FileInfo, r io.Reader) (n int, err error) {
 	return int(written), nil
 }
 
+// Write a hard link to target, a file already in the tar file.
+func (tf *TarFile) WriteLink(info os.FileInfo, target string) error {
+	if tf.w == nil {
+		return writeError
+	}
+
+	header, err := tf.fileHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Typeflag = tar.TypeLink
+	header.Linkname = target
+	header.Size = 0
+	return tf.w.WriteHeader(header)
+}
+
+// Build the tar header for a file.
+func (tf *TarFile) fileHeader(info os.FileInfo) (*tar.Header, error) {
+	// Symlink targets, device numbers and ownership are carried by file info
+	// read back from a backup.
+	fi := fileinfo.NewFileInfo(info)
+	header, err := tar.FileInfoHeader(info, fi.LinkTarget)
+	if err != nil {
+		return nil, err
+	}
+	header.Format = tf.format
+	if info.Mode()&os.ModeDevice != 0 {
+		header.Devmajor = int64(fi.DevMajor)
+		header.Devminor = int64(fi.DevMinor)
+	}
+	header.Uid = fi.Uid
+	header.Gid = fi.Gid
+	header.Uname = fi.User
+	header.Gname = fi.Group
+	// Only PAX archives can hold access and change times and extended
+	// attributes.
+	if tf.format == tar.FormatPAX {
+		header.AccessTime = fi.AccessTime
+		header.ChangeTime = fi.ChangeTime
+		for name, value := range fi.Xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+	return header, nil
+}
+
 // Read metadata from the tarfile.
-func (tf *TarFile) ReadMetadata() (md *metadataRecord, err error) {
+func (tf *TarFile) ReadMetadata() (md *MetadataRecord, err error) {
 	if tf.r == nil {
 		return nil, readError
 	}
@@ -164,7 +233,7 @@ func (tf *TarFile) ReadMetadata() (md *metadataRecord, err error) {
 		return nil, err
 	}
 
-	md = &metadataRecord{
+	md = &MetadataRecord{
 		Name: header.Name,
 		Data: buf.Bytes(),
 	}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tarfile
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+)
+
+// Write only zip archive that implements the FileWriter interface so that
+// it can be used in place of a tarfile.
+type ZipFile struct {
+	w    *zip.Writer
+	size int64
+}
+
+// Create a new zip file for writing.
+func NewZip(w io.Writer) *ZipFile {
+	return &ZipFile{
+		w:    zip.NewWriter(w),
+		size: 0,
+	}
+}
+
+// Close zip file, writes the central directory to the underlying writer.
+func (zf *ZipFile) Close() error {
+	return zf.w.Close()
+}
+
+// Get the amount of file content written.
+func (zf *ZipFile) Size() int64 {
+	return zf.size
+}
+
+// Write content of reader to zip file.
+func (zf *ZipFile) WriteFile(info os.FileInfo, r io.Reader) (n int, err error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return 0, err
+	}
+	header.Method = zip.Deflate
+
+	// Zip stores directories as names ending in a slash and the target of a
+	// symlink as its content.
+	switch {
+	case info.IsDir():
+		header.Name += "/"
+		header.Method = zip.Store
+	case info.Mode()&os.ModeSymlink != 0:
+		r = strings.NewReader(fileinfo.NewFileInfo(info).LinkTarget)
+	}
+
+	w, err := zf.w.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(w, r)
+	if err != nil {
+		return 0, err
+	}
+
+	zf.size += written
+
+	return int(written), nil
+}
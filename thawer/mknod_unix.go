@@ -0,0 +1,44 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thawer
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+)
+
+// Create a named pipe or device node.
+func mknod(target string, info *fileinfo.FileInfo) error {
+	mode := uint32(info.Mode.Perm())
+	switch {
+	case info.Mode&os.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case info.Mode&os.ModeCharDevice != 0:
+		mode |= syscall.S_IFCHR
+	case info.Mode&os.ModeDevice != 0:
+		mode |= syscall.S_IFBLK
+	default:
+		return fmt.Errorf("unable to restore %s with mode %s", target, info.Mode)
+	}
+	return syscall.Mknod(target, mode, int(info.DeviceNumber()))
+}
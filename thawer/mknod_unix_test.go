@@ -0,0 +1,100 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thawer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestThawerSpecialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deepfreeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	backupdir := filepath.Join(dir, "backup")
+	keydir := filepath.Join(dir, "keys")
+	target := filepath.Join(dir, "restore")
+	for _, p := range []string{root, backupdir, keydir} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := freezeTree(t, root, backupdir, keydir)
+
+	// Entries without content are stored as a single empty atom.
+	for p, fd := range tr.Files() {
+		if filepath.Base(p) == "file" {
+			continue
+		}
+		if len(fd.Atoms) != 1 || fd.Atoms[0].Size != 0 {
+			t.Fatalf("unexpected content stored for %s", p)
+		}
+	}
+
+	th, err := New(tr.Id, backupdir, keydir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Thaw(target, root); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(filepath.Join(target, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Fatalf("unexpected directory restored: %s", info.Mode())
+	}
+	link, err := os.Readlink(filepath.Join(target, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "file" {
+		t.Fatalf("unexpected symlink target restored: %s", link)
+	}
+	info, err = os.Lstat(filepath.Join(target, "fifo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 || info.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected fifo restored: %s", info.Mode())
+	}
+}
@@ -0,0 +1,795 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thawer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/elliotpeele/deepfreeze/atom"
+	"github.com/elliotpeele/deepfreeze/cube"
+	"github.com/elliotpeele/deepfreeze/encrypt"
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+	"github.com/elliotpeele/deepfreeze/log"
+	"github.com/elliotpeele/deepfreeze/molecule"
+	"github.com/elliotpeele/deepfreeze/tarfile"
+	"github.com/elliotpeele/deepfreeze/tray"
+	"github.com/elliotpeele/deepfreeze/utils"
+)
+
+// Function called with each fully read molecule.
+type WalkFunc func(m *molecule.Molecule) error
+
+// High level restore structure.
+type Thawer struct {
+	tray      *tray.Tray
+	backupdir string
+	em        *encrypt.EncryptionManager
+	includes  []string
+	excludes  []string
+	selected  map[string]bool
+	relocated map[string]string
+	mapOwners bool
+	xattrs    bool
+	filter    []string
+}
+
+// Create a new thawer instance. The state of the tray is restored, merging
+// incremental trays with their parents. Only files matching one of the
+// include patterns, if any are given, and none of the exclude patterns are
+// restored.
+func New(trayId string, backupdir string, keyringdir string, includes []string, excludes []string) (*Thawer, error) {
+	t, err := tray.Open(backupdir, trayId)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.LoadParents(); err != nil {
+		return nil, err
+	}
+	em, err := encrypt.New(keyringdir)
+	if err != nil {
+		return nil, err
+	}
+	return &Thawer{
+		tray:      t,
+		backupdir: backupdir,
+		em:        em,
+		includes:  includes,
+		excludes:  excludes,
+		selected:  make(map[string]bool),
+		relocated: make(map[string]string),
+		xattrs:    true,
+	}, nil
+}
+
+// Restore file ownership by user and group name rather than by numeric id,
+// for restoring on a different host.
+func (t *Thawer) SetMapOwners(byName bool) {
+	t.mapOwners = byName
+}
+
+// Set whether extended attributes and ACLs are restored. If filter patterns
+// are given, only attributes with names matching one of them are restored.
+func (t *Thawer) SetXattrs(restore bool, filter []string) {
+	t.xattrs = restore
+	t.filter = filter
+}
+
+// Check if a path should be restored based on the include and exclude
+// patterns.
+func (t *Thawer) match(p string) (bool, error) {
+	if len(t.includes) > 0 {
+		included := false
+		for _, pattern := range t.includes {
+			matched, err := utils.MatchPath(pattern, p)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false, nil
+		}
+	}
+	for _, pattern := range t.excludes {
+		matched, err := utils.MatchPath(pattern, p)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Select the newest version of each file to restore from the tray chain and
+// return the set of cubes that hold their atoms. Hard links need the content
+// of the file they link to, if that file is not selected itself its content
+// is restored in place of the first link.
+func (t *Thawer) selectMolecules() (map[string]bool, error) {
+	cubes := make(map[string]bool)
+	files := t.tray.Files()
+	needed := make(map[string][]string)
+	for p, fd := range files {
+		matched, err := t.match(p)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+		t.selected[fd.Id] = true
+		for _, id := range fd.Cubes {
+			cubes[id] = true
+		}
+		if fd.LinkTo != "" {
+			needed[fd.LinkTo] = append(needed[fd.LinkTo], p)
+		}
+	}
+
+	for p, links := range needed {
+		fd, ok := files[p]
+		if !ok {
+			return nil, fmt.Errorf("missing %s, which %s is a hard link to", p, links[0])
+		}
+		if t.selected[fd.Id] {
+			continue
+		}
+		sort.Strings(links)
+		t.selected[fd.Id] = true
+		t.relocated[fd.Id] = links[0]
+		for _, id := range fd.Cubes {
+			cubes[id] = true
+		}
+	}
+	return cubes, nil
+}
+
+// Get the stored path that the content of a molecule is restored at.
+func (t *Thawer) contentPath(m *molecule.Molecule) string {
+	if p, ok := t.relocated[m.Id]; ok {
+		return p
+	}
+	return m.Path
+}
+
+// Map a stored molecule path to its location under the target root, removing
+// the strip prefix if the path has it. Absolute paths are treated as relative
+// to the target root, and paths that would escape it are refused.
+func targetPath(root string, stripPrefix string, p string) (string, error) {
+	p = filepath.Clean(p)
+	if stripPrefix != "" {
+		rel, err := filepath.Rel(filepath.Clean(stripPrefix), p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			p = rel
+		}
+	}
+
+	root = filepath.Clean(root)
+	target := filepath.Join(root, p)
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to restore %s outside of %s", p, root)
+	}
+	return target, nil
+}
+
+// Restore a directory tree from a tray into root, removing stripPrefix from
+// the stored paths.
+func (t *Thawer) Thaw(root string, stripPrefix string) error {
+	// Directory permissions and times are applied once everything inside
+	// has been restored, hard links once the file they link to has been.
+	dirs := make(map[string]*fileinfo.FileInfo)
+	restored := make(map[string]string)
+	var links []*hardLink
+	err := t.Walk(func(m *molecule.Molecule) error {
+		target, err := targetPath(root, stripPrefix, t.contentPath(m))
+		if err != nil {
+			return err
+		}
+		if m.LinkTo != "" {
+			links = append(links, &hardLink{path: target, linkTo: m.LinkTo})
+			return nil
+		}
+		restored[m.Path] = target
+		if info := m.OrigInfo(); info != nil && info.IsDir() {
+			dirs[target] = fileinfo.NewFileInfo(info)
+		}
+		return t.thawMolecule(m, root, target)
+	})
+	if err != nil {
+		return err
+	}
+	if err := restoreLinks(root, links, restored); err != nil {
+		return err
+	}
+	return t.restoreDirs(dirs)
+}
+
+// A hard link to be created once the file it links to has been restored.
+type hardLink struct {
+	path   string
+	linkTo string
+	info   *fileinfo.FileInfo
+}
+
+// Create hard links to restored files under root. Restored maps the stored
+// path of each file to where it was restored.
+func restoreLinks(root string, links []*hardLink, restored map[string]string) error {
+	for _, l := range links {
+		src, ok := restored[l.linkTo]
+		if !ok {
+			return fmt.Errorf("unable to restore hard link %s, %s was not restored", l.path, l.linkTo)
+		}
+		// The content was restored in place of this link.
+		if src == l.path {
+			continue
+		}
+		log.Infof("Linking %s to %s", l.path, src)
+		if err := makeParents(root, l.path); err != nil {
+			return err
+		}
+		if err := removeExisting(l.path); err != nil {
+			return err
+		}
+		if err := os.Link(src, l.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the files stored in a tray to an archive, removing stripPrefix from
+// the stored paths. Archive formats that can not store hard links get a copy
+// of the content under the path of each link.
+func (t *Thawer) Export(w tarfile.FileWriter, stripPrefix string) error {
+	lw, canLink := w.(tarfile.LinkWriter)
+	var copies map[string][]string
+	if !canLink {
+		var err error
+		copies, err = t.selectedLinks()
+		if err != nil {
+			return err
+		}
+	}
+	// Hard links are written after the file they link to.
+	exported := make(map[string]string)
+	var links []*hardLink
+	err := t.Walk(func(m *molecule.Molecule) error {
+		name, err := targetPath(".", stripPrefix, t.contentPath(m))
+		if err != nil {
+			return err
+		}
+		if m.LinkTo != "" {
+			// Copies are written along with the file they link to.
+			if !canLink {
+				return nil
+			}
+			links = append(links, &hardLink{
+				path:   name,
+				linkTo: m.LinkTo,
+				info:   fileinfo.NewFileInfo(m.OrigInfo()),
+			})
+			return nil
+		}
+		exported[m.Path] = name
+		if err := t.exportMolecule(m, name, w); err != nil {
+			return err
+		}
+		return t.exportCopies(m, name, stripPrefix, copies[m.Path], w)
+	})
+	if err != nil || !canLink {
+		return err
+	}
+	return exportLinks(links, exported, lw)
+}
+
+// Get the paths of the selected hard links to each file, keyed by the path
+// of the file they link to.
+func (t *Thawer) selectedLinks() (map[string][]string, error) {
+	links := make(map[string][]string)
+	for p, fd := range t.tray.Files() {
+		if fd.LinkTo == "" {
+			continue
+		}
+		matched, err := t.match(p)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			links[fd.LinkTo] = append(links[fd.LinkTo], p)
+		}
+	}
+	for _, paths := range links {
+		sort.Strings(paths)
+	}
+	return links, nil
+}
+
+// Write the content of an unpacked molecule to an archive again for each of
+// the hard link paths, except for the link it was exported as.
+func (t *Thawer) exportCopies(m *molecule.Molecule, name string, stripPrefix string, paths []string, w tarfile.FileWriter) error {
+	for _, p := range paths {
+		copyName, err := targetPath(".", stripPrefix, p)
+		if err != nil {
+			return err
+		}
+		if copyName == name {
+			continue
+		}
+		if err := m.Rewind(); err != nil {
+			return err
+		}
+		if err := t.exportMolecule(m, copyName, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write hard links to exported files to an archive. Exported maps the
+// stored path of each file to its name in the archive.
+func exportLinks(links []*hardLink, exported map[string]string, w tarfile.LinkWriter) error {
+	for _, l := range links {
+		src, ok := exported[l.linkTo]
+		if !ok {
+			return fmt.Errorf("unable to export hard link %s, %s was not exported", l.path, l.linkTo)
+		}
+		if src == l.path {
+			continue
+		}
+		log.Infof("Exporting %s as a link to %s", l.path, src)
+		l.info.Name = l.path
+		if err := w.WriteLink(l.info.FileInfo(), src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the selected molecules from the tray, calling fn for each one after
+// it has been decrypted and decompressed.
+func (t *Thawer) Walk(fn WalkFunc) error {
+	return t.walk(func(m *molecule.Molecule) error {
+		// Hard links, directories, symlinks and special files have no stored
+		// content. Older backups stored empty content for the latter, which
+		// is unpacked like that of any other file.
+		if m.Info().Size() > 0 {
+			if err := unpackMolecule(m); err != nil {
+				return err
+			}
+		}
+		return fn(m)
+	})
+}
+
+// Read the selected molecules from the tray, calling fn for each one with
+// the content still compressed and encrypted as it is stored in the cubes.
+func (t *Thawer) WalkPacked(fn WalkFunc) error {
+	return t.walk(func(m *molecule.Molecule) error {
+		// Rewind the backing file so that it can be read.
+		if _, err := m.Seek(0, 0); err != nil {
+			return err
+		}
+		return fn(m)
+	})
+}
+
+// Read every file stored in the tray itself, leaving out its parents and
+// deleted files, calling fn for each one with the content still compressed
+// and encrypted as it is stored in the cubes.
+func (t *Thawer) WalkTrayPacked(fn WalkFunc) error {
+	cubes := make(map[string]bool)
+	for _, cd := range t.tray.Cubes {
+		for _, f := range cd.Files {
+			if f.Deleted {
+				continue
+			}
+			t.selected[f.Id] = true
+			for _, id := range f.Cubes {
+				cubes[id] = true
+			}
+		}
+	}
+	return t.walkTray(t.tray, cubes, func(m *molecule.Molecule) error {
+		// Rewind the backing file so that it can be read.
+		if _, err := m.Seek(0, 0); err != nil {
+			return err
+		}
+		return fn(m)
+	})
+}
+
+// Read the selected molecules from the tray chain, calling fn for each one.
+func (t *Thawer) walk(fn WalkFunc) error {
+	cubes, err := t.selectMolecules()
+	if err != nil {
+		return err
+	}
+	chain := t.tray.Chain()
+	total := 0
+	for _, tr := range chain {
+		total += len(tr.Cubes)
+	}
+	log.Infof("restoring %d files from %d of %d cubes in %d trays", len(t.selected), len(cubes), total, len(chain))
+
+	for _, tr := range chain {
+		if err := t.walkTray(tr, cubes, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the selected cubes of a single tray, calling fn for each selected
+// molecule.
+func (t *Thawer) walkTray(tr *tray.Tray, cubes map[string]bool, fn WalkFunc) error {
+	var cur *molecule.Molecule
+	for _, cd := range tr.Cubes {
+		if !cubes[cd.Id] {
+			log.Debugf("skipping cube %s", cd.Id)
+			continue
+		}
+		log.Debugf("opening cube %s", cd.Id)
+		c, err := cube.Open(cube.Path(t.backupdir, cd.Id))
+		if err != nil {
+			return err
+		}
+		cur, err = t.thawCube(c, cur, fn)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	// A molecule that is still in progress is missing atoms.
+	if cur != nil {
+		cur.Close()
+		return fmt.Errorf("incomplete backup data for %s", cur.Path)
+	}
+	return nil
+}
+
+// Read all records from a cube, passing molecules to fn as they are
+// completed. Molecules may span cubes, so the molecule in progress is
+// passed in and returned. Records for molecules that are not selected are
+// skipped.
+func (t *Thawer) thawCube(c *cube.Cube, cur *molecule.Molecule, fn WalkFunc) (*molecule.Molecule, error) {
+	skipping := false
+	for {
+		md, err := c.ReadMetadata()
+		if err == io.EOF {
+			return cur, nil
+		}
+		if err != nil {
+			return cur, err
+		}
+
+		switch md.Name {
+		case "molecule":
+			if cur != nil {
+				return cur, fmt.Errorf("incomplete backup data for %s", cur.Path)
+			}
+			m, err := molecule.ParseMolecule(md.Data, t.em)
+			if err != nil {
+				return nil, err
+			}
+			skipping = !t.selected[m.Id]
+			if skipping {
+				continue
+			}
+			if err := m.Create(); err != nil {
+				return nil, err
+			}
+			cur = m
+		case "finfo", "bfinfo":
+			if skipping {
+				continue
+			}
+			if cur == nil {
+				return nil, fmt.Errorf("found %s record without a molecule", md.Name)
+			}
+			info, err := fileinfo.ParseFileInfo(md.Data)
+			if err != nil {
+				return cur, err
+			}
+			if md.Name == "finfo" {
+				cur.SetOrigInfo(info.FileInfo())
+			} else {
+				cur.SetInfo(info.FileInfo())
+			}
+		case "atom":
+			a, err := atom.ParseAtom(md.Data)
+			if err != nil {
+				return cur, err
+			}
+			if !t.selected[a.MoleculeId] {
+				if _, err := c.ReadFile(ioutil.Discard); err != nil {
+					return cur, err
+				}
+				continue
+			}
+			if cur == nil || a.MoleculeId != cur.Id {
+				return cur, fmt.Errorf("found atom %s for unknown molecule %s", a.Id, a.MoleculeId)
+			}
+			if _, err := c.ReadFile(cur); err != nil {
+				return cur, err
+			}
+			cur.Atoms = append(cur.Atoms, a)
+			if cur.IsComplete() {
+				if err := fn(cur); err != nil {
+					cur.Close()
+					return nil, err
+				}
+				if err := cur.Close(); err != nil {
+					return nil, err
+				}
+				cur = nil
+			}
+		default:
+			return cur, fmt.Errorf("unexpected record %s in cube %s", md.Name, c.Id)
+		}
+	}
+}
+
+// Decrypt and decompress a fully read molecule.
+func unpackMolecule(m *molecule.Molecule) error {
+	// Rewind the backing file so that it can be decrypted.
+	if _, err := m.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := m.Decrypt(); err != nil {
+		return err
+	}
+	return m.Decompress()
+}
+
+// Create the missing parent directories of target below root. Existing
+// parents are checked as well, a symlink left by an earlier restore must not
+// redirect the restore outside of root.
+func makeParents(root string, target string) error {
+	root = filepath.Clean(root)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	p := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, name)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to restore %s through symlink %s", target, p)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("unable to restore %s, %s is not a directory", target, p)
+		}
+	}
+	return nil
+}
+
+// Remove an existing entry at target that is not a directory, so that it is
+// replaced rather than written through.
+func removeExisting(target string) error {
+	existing, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.IsDir() {
+		return nil
+	}
+	return os.Remove(target)
+}
+
+// Recreate the file stored in an unpacked molecule at target, which must be
+// below root.
+func (t *Thawer) thawMolecule(m *molecule.Molecule, root string, target string) error {
+	log.Infof("Restoring %s to %s", m.Path, target)
+	if err := makeParents(root, target); err != nil {
+		return err
+	}
+	// Replace whatever is in the way of the new entry.
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+	orig := m.OrigInfo()
+	if orig == nil || orig.Mode().IsRegular() {
+		return t.thawFile(m, target)
+	}
+
+	info := fileinfo.NewFileInfo(orig)
+	switch {
+	case info.IsDir:
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	case info.Mode&os.ModeSymlink != 0:
+		if err := os.Symlink(info.LinkTarget, target); err != nil {
+			return err
+		}
+	default:
+		if err := mknod(target, info); err != nil {
+			// Only root may create device nodes.
+			if os.IsPermission(err) && os.Geteuid() != 0 {
+				log.Warningf("skipping %s, unable to create it without root: %s", target, err)
+				return nil
+			}
+			return err
+		}
+	}
+	return t.restoreMetadata(target, info)
+}
+
+// Write the content of an unpacked molecule to a new regular file at target.
+// Anything in the way must already be removed, the file is created
+// exclusively so that a symlink in its place is never followed.
+func (t *Thawer) thawFile(m *molecule.Molecule, target string) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, m); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Restore the original ownership, permissions and times.
+	info := m.OrigInfo()
+	if info == nil {
+		return nil
+	}
+	return t.restoreMetadata(target, fileinfo.NewFileInfo(info))
+}
+
+// Apply the original ownership, permissions and access and modification
+// times to a restored file. Ownership can only be changed when running as
+// root. The change time is set by the system and can not be restored.
+func (t *Thawer) restoreMetadata(target string, info *fileinfo.FileInfo) error {
+	if os.Geteuid() == 0 {
+		uid, gid := info.Owner(t.mapOwners)
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+	}
+	// Changing the permissions or times of a symlink changes its target.
+	if info.Mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	// Permissions are set after the owner, changing the owner clears the
+	// setuid and setgid bits.
+	perm := info.Mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(target, perm); err != nil {
+		return err
+	}
+	if err := t.restoreXattrs(target, info); err != nil {
+		return err
+	}
+	atime := info.AccessTime
+	if atime.IsZero() {
+		atime = info.ModTime
+	}
+	return os.Chtimes(target, atime, info.ModTime)
+}
+
+// Reapply the extended attributes of a restored file that pass the filter.
+// Attributes that can not be set, for example because the filesystem or
+// security policy of this host does not allow them, are skipped with a
+// warning.
+func (t *Thawer) restoreXattrs(target string, info *fileinfo.FileInfo) error {
+	if !t.xattrs {
+		return nil
+	}
+	var names []string
+	for name := range info.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		matched, err := t.matchXattr(name)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+		if err := fileinfo.SetXattr(target, name, info.Xattrs[name]); err != nil {
+			log.Warningf("unable to restore %s on %s: %s", name, target, err)
+		}
+	}
+	return nil
+}
+
+// Check if an extended attribute passes the filter.
+func (t *Thawer) matchXattr(name string) (bool, error) {
+	if len(t.filter) == 0 {
+		return true, nil
+	}
+	for _, pattern := range t.filter {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// Apply the original metadata to restored directories, deepest first so that
+// restoring a directory does not change its parent.
+func (t *Thawer) restoreDirs(dirs map[string]*fileinfo.FileInfo) error {
+	var paths []string
+	for p := range dirs {
+		paths = append(paths, p)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, p := range paths {
+		if err := t.restoreMetadata(p, dirs[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the content of an unpacked molecule to an archive under name.
+func (t *Thawer) exportMolecule(m *molecule.Molecule, name string, w tarfile.FileWriter) error {
+	log.Infof("Exporting %s as %s", m.Path, name)
+	info := &fileinfo.FileInfo{
+		Mode: 0644,
+	}
+	// Keep the original type, permissions and modification time.
+	if orig := m.OrigInfo(); orig != nil {
+		info = fileinfo.NewFileInfo(orig)
+	}
+	info.Name = name
+	info.Size = m.Size()
+	_, err := w.WriteFile(info.FileInfo(), m)
+	return err
+}
@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thawer
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/elliotpeele/deepfreeze/encrypt"
+	"github.com/elliotpeele/deepfreeze/indexer"
+	"github.com/elliotpeele/deepfreeze/molecule"
+	"github.com/elliotpeele/deepfreeze/tarfile"
+	"github.com/elliotpeele/deepfreeze/tray"
+)
+
+// Back up a directory tree into a new tray the way the freezer does, which
+// can not be used here as it depends on this package.
+func freezeTree(t *testing.T, root string, backupdir string, keydir string) *tray.Tray {
+	em, err := encrypt.New(keydir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := em.GenKey(); err != nil {
+		t.Fatal(err)
+	}
+	idx := indexer.New(root, nil)
+	files, err := idx.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := idx.Links()
+	tr, err := tray.New(root, backupdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		sum := fmt.Sprintf("%x", files[p])
+		var m *molecule.Molecule
+		if linkTo, ok := links[p]; ok {
+			if m, err = molecule.NewLink(p, sum, linkTo); err == nil {
+				_, err = tr.WriteLink(m)
+			}
+		} else if m, err = molecule.New(p, sum, em); err == nil {
+			_, err = tr.WriteMolecule(m)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.CurrentCube().Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestThawerMatch(t *testing.T) {
+	th := &Thawer{
+		includes: []string{"src/etc", "*.conf"},
+		excludes: []string{"src/etc/secret*"},
+	}
+
+	tests := map[string]bool{
+		"src/etc/hosts":       true,
+		"src/etc/sub/fstab":   true,
+		"app.conf":            true,
+		"src/etc/secret.key":  false,
+		"src/var/log/message": false,
+		"/srv/app.conf":       true,
+	}
+	for p, expected := range tests {
+		matched, err := th.match(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != expected {
+			t.Fatalf("unexpected match for %s: %v", p, matched)
+		}
+	}
+}
+
+func TestThawerMatchAbsolute(t *testing.T) {
+	// Patterns from the restore help, applied to a backup of /.
+	th := &Thawer{includes: []string{"etc/*.conf"}}
+
+	tests := map[string]bool{
+		"/etc/foo.conf":        true,
+		"/srv/etc/app.conf":    true,
+		"/etc/hosts":           false,
+		"/etc/sub/nested.conf": false,
+	}
+	for p, expected := range tests {
+		matched, err := th.match(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != expected {
+			t.Fatalf("unexpected match for %s: %v", p, matched)
+		}
+	}
+
+	th = &Thawer{includes: []string{"/etc/*.conf"}}
+	if matched, _ := th.match("/srv/etc/app.conf"); matched {
+		t.Fatal("expected absolute pattern to only match from the start of the path")
+	}
+}
+
+func TestThawerTargetPath(t *testing.T) {
+	tests := []struct {
+		strip    string
+		path     string
+		expected string
+	}{
+		{"", "src/etc/hosts", "/mnt/recovery/src/etc/hosts"},
+		{"/srv", "/srv/data/db", "/mnt/recovery/data/db"},
+		{"/srv", "/opt/data/db", "/mnt/recovery/opt/data/db"},
+		{"", "/etc/../../etc/passwd", "/mnt/recovery/etc/passwd"},
+	}
+	for _, test := range tests {
+		target, err := targetPath("/mnt/recovery", test.strip, test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != test.expected {
+			t.Fatalf("unexpected target for %s: %s", test.path, target)
+		}
+	}
+
+	if _, err := targetPath("/mnt/recovery", "", "../etc/passwd"); err == nil {
+		t.Fatal("expected error for path outside of target root")
+	}
+}
+
+func TestThawerMatchXattr(t *testing.T) {
+	th := &Thawer{filter: []string{"user.*", "security.selinux"}}
+
+	tests := map[string]bool{
+		"user.comment":             true,
+		"security.selinux":         true,
+		"security.capability":      false,
+		"system.posix_acl_access":  false,
+		"trusted.overlay.redirect": false,
+	}
+	for name, expected := range tests {
+		matched, err := th.matchXattr(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != expected {
+			t.Fatalf("unexpected match for %s: %v", name, matched)
+		}
+	}
+
+	th.filter = nil
+	if matched, _ := th.matchXattr("trusted.overlay.redirect"); !matched {
+		t.Fatal("expected all attributes to match without a filter")
+	}
+}
+
+func TestThawerSymlinkEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deepfreeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, p := range []string{root, outside} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Left behind by an earlier restore.
+	if err := os.Symlink(outside, filepath.Join(root, "parent")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	th := &Thawer{}
+	thaw := func(target string) error {
+		m, err := molecule.New(src, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		return th.thawMolecule(m, root, target)
+	}
+
+	if err := thaw(filepath.Join(root, "parent", "passwd")); err == nil {
+		t.Fatal("expected error for restoring through a symlinked parent")
+	}
+	if err := thaw(filepath.Join(root, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unexpected files written outside of the target root: %d", len(entries))
+	}
+	info, err := os.Lstat(filepath.Join(root, "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Fatalf("expected symlink to be replaced by a regular file, found %s", info.Mode())
+	}
+}
+
+func TestThawerExportZipLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deepfreeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	backupdir := filepath.Join(dir, "backup")
+	keydir := filepath.Join(dir, "keys")
+	for _, p := range []string{root, backupdir, keydir} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := filepath.Join(root, "a")
+	if err := ioutil.WriteFile(a, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hl := filepath.Join(root, "hl")
+	if err := os.Link(a, hl); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := freezeTree(t, root, backupdir, keydir)
+
+	th, err := New(tr.Id, backupdir, keydir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zf := tarfile.NewZip(&buf)
+	if err := th.Export(zf, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := zf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Zip files can not store hard links, the content is stored twice.
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name] = string(data)
+	}
+	for _, name := range []string{"a", "hl"} {
+		if contents[name] != "content" {
+			t.Fatalf("unexpected content for %s: %q", name, contents[name])
+		}
+	}
+}
+
+func TestThawerRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deepfreeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	backupdir := filepath.Join(dir, "backup")
+	keydir := filepath.Join(dir, "keys")
+	target := filepath.Join(dir, "restore")
+	for _, p := range []string{root, backupdir, keydir} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		"a":          "alpha",
+		"empty":      "",
+		"sub/b":      "bravo",
+		"sub/deep/c": strings.Repeat("charlie", 100000),
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr := freezeTree(t, root, backupdir, keydir)
+	th, err := New(tr.Id, backupdir, keydir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := th.Thaw(target, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		data, err := ioutil.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("unexpected content restored for %s", name)
+		}
+		orig, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != orig.Mode() || !info.ModTime().Equal(orig.ModTime()) {
+			t.Fatalf("unexpected metadata restored for %s: %s %s", name, info.Mode(), info.ModTime())
+		}
+	}
+}
@@ -17,9 +17,19 @@
 package tray
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/elliotpeele/deepfreeze/atom"
 	"github.com/elliotpeele/deepfreeze/cube"
+	"github.com/elliotpeele/deepfreeze/fileinfo"
 	"github.com/elliotpeele/deepfreeze/log"
 	"github.com/elliotpeele/deepfreeze/molecule"
 	"github.com/elliotpeele/deepfreeze/utils"
@@ -29,55 +39,259 @@ import (
 // Top level structure for any single backup. Contains reference to
 // previous tray.
 type Tray struct {
-	Id          string       `json:"tray_id"`
-	CreatedAt   time.Time    `json:"created_at"`
-	IsUploaded  bool         `json:"-"`
-	Hash        string       `json:"-"`
-	Full        bool         `json:"full"`
-	Incremental bool         `json:"incremental"`
-	Parent      *Tray        `json:"-"`
-	UploadedAt  time.Time    `json:"-"`
-	Size        int64        `json:"size"`
-	Cubes       []*cube_data `json:"cubes"`
-	rootCube    *cube.Cube
-	curCube     *cube.Cube
-	backupdir   string
+	Id               string       `json:"tray_id"`
+	Root             string       `json:"root"`
+	CreatedAt        time.Time    `json:"created_at"`
+	IsUploaded       bool         `json:"-"`
+	Hash             string       `json:"-"`
+	Full             bool         `json:"full"`
+	Incremental      bool         `json:"incremental"`
+	Differential     bool         `json:"differential"`
+	ConsolidatedFrom string       `json:"consolidated_from"`
+	ParentId         string       `json:"parent_id"`
+	Parent           *Tray        `json:"-"`
+	UploadedAt       time.Time    `json:"-"`
+	Size             int64        `json:"size"`
+	Cubes            []*cube_data `json:"cubes"`
+	rootCube         *cube.Cube
+	curCube          *cube.Cube
+	backupdir        string
 }
 
 // Structure for storing cube metadata.
 type cube_data struct {
 	Id    string       `json:"cube_id"`
 	Hash  string       `json:"hash"`
+	Size  int64        `json:"size"`
 	Files []*file_data `json:"files"`
 }
 
 // Structure for storing file metaadata.
 type file_data struct {
-	Id   string `json:"file_id"`
-	Hash string `json:"hash"`
-	Path string `json:"path"`
+	Id        string             `json:"file_id"`
+	Hash      string             `json:"hash"`
+	Path      string             `json:"path"`
+	Size      int64              `json:"size"`
+	CreatedAt time.Time          `json:"created_at"`
+	Info      *fileinfo.FileInfo `json:"info"`
+	Deleted   bool               `json:"deleted"`
+	LinkTo    string             `json:"link_to,omitempty"`
+	Cubes     []string           `json:"cubes"`
+	Atoms     []*atom.Atom       `json:"atoms"`
 }
 
-// Create a new tray instance.
-func New(backupdir string) (*Tray, error) {
+// Create a new tray instance for backing up root.
+func New(root string, backupdir string) (*Tray, error) {
 	c, err := cube.New(1024, backupdir)
 	if err != nil {
 		return nil, err
 	}
 	t := &Tray{
-		Id:          uuid.NewV4().String(),
-		IsUploaded:  false,
-		Full:        true,
-		Incremental: false,
-		Parent:      nil,
-		Size:        0,
-		rootCube:    c,
-		backupdir:   backupdir,
+		Id:           uuid.NewV4().String(),
+		Root:         root,
+		CreatedAt:    time.Now(),
+		IsUploaded:   false,
+		Full:         true,
+		Incremental:  false,
+		Differential: false,
+		Parent:       nil,
+		Size:         0,
+		rootCube:     c,
+		backupdir:    backupdir,
 	}
 	c.TrayId = t.Id
 	return t, nil
 }
 
+// Load a tray from its metadata file in the backup directory.
+func Open(backupdir string, id string) (*Tray, error) {
+	buf, err := ioutil.ReadFile(path.Join(backupdir, fmt.Sprintf("tray-%s", id)))
+	if err != nil {
+		return nil, err
+	}
+	t := &Tray{
+		backupdir: backupdir,
+	}
+	if err := t.unpackHeader(buf); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Get the ids of all tray metadata files in the backup directory, whether or
+// not they can be read.
+func Ids(backupdir string) ([]string, error) {
+	names, err := filepath.Glob(path.Join(backupdir, "tray-*"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, name := range names {
+		ids = append(ids, strings.TrimPrefix(path.Base(name), "tray-"))
+	}
+	return ids, nil
+}
+
+// Load all trays from the backup directory, oldest first. Trays that can not
+// be read are skipped with a warning.
+func List(backupdir string) ([]*Tray, error) {
+	ids, err := Ids(backupdir)
+	if err != nil {
+		return nil, err
+	}
+	var trays []*Tray
+	for _, id := range ids {
+		t, err := Open(backupdir, id)
+		if err != nil {
+			log.Warningf("skipping unreadable tray %s: %s", id, err)
+			continue
+		}
+		trays = append(trays, t)
+	}
+	sort.Slice(trays, func(i, j int) bool {
+		// Consolidated trays share the creation time of the tray they were
+		// built from, prefer the full tray.
+		if trays[i].CreatedAt.Equal(trays[j].CreatedAt) {
+			return !trays[i].Full && trays[j].Full
+		}
+		return trays[i].CreatedAt.Before(trays[j].CreatedAt)
+	})
+	return trays, nil
+}
+
+// Get the roots with backups in the backup directory, sorted.
+func Roots(backupdir string) ([]string, error) {
+	trays, err := List(backupdir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var roots []string
+	for _, t := range trays {
+		root := path.Clean(t.Root)
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// Find the most recent tray in the backup directory for root. Returns nil if
+// there is no backup of root.
+func Latest(backupdir string, root string) (*Tray, error) {
+	return LatestBefore(backupdir, root, time.Now())
+}
+
+// Find the most recent full tray in the backup directory for root. Returns
+// nil if there is no full backup of root.
+func LatestFull(backupdir string, root string) (*Tray, error) {
+	return latest(backupdir, root, func(t *Tray) bool {
+		return t.Full
+	})
+}
+
+// Find the most recent tray in the backup directory for root created at or
+// before a point in time. Trays for any root are considered if root is
+// empty. Returns nil if there is no such tray.
+func LatestBefore(backupdir string, root string, at time.Time) (*Tray, error) {
+	return latest(backupdir, root, func(t *Tray) bool {
+		return !t.CreatedAt.After(at)
+	})
+}
+
+// Find the most recent tray for root that matches. Trays for any root are
+// considered if root is empty.
+func latest(backupdir string, root string, match func(t *Tray) bool) (*Tray, error) {
+	trays, err := List(backupdir)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(trays) - 1; i >= 0; i-- {
+		if root != "" && path.Clean(trays[i].Root) != path.Clean(root) {
+			continue
+		}
+		if match(trays[i]) {
+			return trays[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Make the tray an incremental backup on top of parent.
+func (t *Tray) SetParent(parent *Tray) {
+	t.Parent = parent
+	t.ParentId = parent.Id
+	t.Full = false
+	t.Incremental = true
+}
+
+// Make the tray a differential backup on top of the full backup parent.
+func (t *Tray) SetDifferentialParent(parent *Tray) {
+	t.SetParent(parent)
+	t.Incremental = false
+	t.Differential = true
+}
+
+// Load the chain of parent trays back to the last full backup.
+func (t *Tray) LoadParents() error {
+	cur := t
+	for cur.ParentId != "" {
+		if cur.Parent == nil {
+			p, err := Open(t.backupdir, cur.ParentId)
+			if err != nil {
+				return err
+			}
+			cur.Parent = p
+		}
+		cur = cur.Parent
+	}
+	return nil
+}
+
+// Get the tray and its parents, oldest first. The parents must already be
+// loaded.
+func (t *Tray) Chain() []*Tray {
+	var chain []*Tray
+	for cur := t; cur != nil; cur = cur.Parent {
+		chain = append([]*Tray{cur}, chain...)
+	}
+	return chain
+}
+
+// Get the latest version of every file in the tray and its parents, keyed
+// by path. Files that were deleted are left out. The parents must already be
+// loaded.
+func (t *Tray) Files() map[string]*file_data {
+	files := make(map[string]*file_data)
+	for cur := t; cur != nil; cur = cur.Parent {
+		for _, c := range cur.Cubes {
+			for _, f := range c.Files {
+				// Newer trays take precedence over their parents.
+				if _, ok := files[f.Path]; !ok {
+					files[f.Path] = f
+				}
+			}
+		}
+	}
+	for p, f := range files {
+		if f.Deleted {
+			delete(files, p)
+		}
+	}
+	return files
+}
+
+// Get the number of files stored in the tray.
+func (t *Tray) FileCount() int {
+	count := 0
+	for _, c := range t.Cubes {
+		count += len(c.Files)
+	}
+	return count
+}
+
 // Get the current cube from the tray.
 func (t *Tray) CurrentCube() *cube.Cube {
 	cur := t.rootCube
@@ -90,6 +304,11 @@ func (t *Tray) CurrentCube() *cube.Cube {
 // Write a molecule to the tray.
 func (t *Tray) WriteMolecule(m *molecule.Molecule) (n int, err error) {
 	log.Infof("Backing up %s", m.Path)
+	// Directories, symlinks and special files are recreated from their file
+	// info, like hard links they are stored without content.
+	if !m.OrigInfo().Mode().IsRegular() {
+		return t.CurrentCube().WriteMolecule(m)
+	}
 	// Open the backend file, hopefully it still exists.
 	if err := m.Open(); err != nil {
 		return 0, err
@@ -107,11 +326,54 @@ func (t *Tray) WriteMolecule(m *molecule.Molecule) (n int, err error) {
 	return t.CurrentCube().WriteMolecule(m)
 }
 
+// Write a molecule for a hard link to the tray. Only the link is recorded,
+// the content is stored with the linked file.
+func (t *Tray) WriteLink(m *molecule.Molecule) (n int, err error) {
+	log.Infof("Linking %s to %s", m.Path, m.LinkTo)
+	return t.CurrentCube().WriteMolecule(m)
+}
+
+// Record that a file was deleted since the parent tray.
+func (t *Tray) WriteTombstone(path string) error {
+	log.Infof("Recording deletion of %s", path)
+	return t.CurrentCube().WriteTombstone(molecule.NewTombstone(path))
+}
+
+// Write a molecule that is already compressed and encrypted to the tray.
+func (t *Tray) WritePackedMolecule(m *molecule.Molecule) (n int, err error) {
+	log.Infof("Copying %s", m.Path)
+	return t.CurrentCube().WriteMolecule(m)
+}
+
 // Upload a frozen tray.
 func (t *Tray) Upload() error {
 	return nil
 }
 
+// Write out the tray metadata file to the backup directory. The file is
+// written to a tmp file first so that an interrupted save does not leave a
+// truncated tray behind.
+func (t *Tray) Save() error {
+	header, err := t.Header()
+	if err != nil {
+		return err
+	}
+	tmpf, err := ioutil.TempFile(t.backupdir, "deepfreeze")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpf.Write(header); err != nil {
+		tmpf.Close()
+		os.Remove(tmpf.Name())
+		return err
+	}
+	if err := tmpf.Close(); err != nil {
+		os.Remove(tmpf.Name())
+		return err
+	}
+	return os.Rename(tmpf.Name(), path.Join(t.backupdir, fmt.Sprintf("tray-%s", t.Id)))
+}
+
 // Write header to current cube.
 func (t *Tray) Header() ([]byte, error) {
 	log.Debug("packing tray header")
@@ -121,24 +383,40 @@ func (t *Tray) Header() ([]byte, error) {
 		c := &cube_data{
 			Id:   cube.Id,
 			Hash: cube.Hash,
+			Size: cube.Size,
 		}
 		for _, mol := range cube.Molecules {
 			f := &file_data{
-				Id:   mol.Id,
-				Hash: mol.Hash,
-				Path: mol.Path,
+				Id:        mol.Id,
+				Hash:      mol.Hash,
+				Path:      mol.Path,
+				Size:      mol.OriginalSize,
+				CreatedAt: mol.CreatedAt,
+				Deleted:   mol.IsDeleted(),
+				LinkTo:    mol.LinkTo,
+				Atoms:     mol.Atoms,
+			}
+			if info := mol.OrigInfo(); info != nil {
+				f.Info = fileinfo.NewFileInfo(info)
+			}
+			// Record every cube that holds part of the file.
+			for _, a := range mol.Atoms {
+				if len(f.Cubes) == 0 || f.Cubes[len(f.Cubes)-1] != a.CubeId {
+					f.Cubes = append(f.Cubes, a.CubeId)
+				}
 			}
 			log.Debugf("packing file %s", f.Id)
 			c.Files = append(c.Files, f)
 		}
 		t.Cubes = append(t.Cubes, c)
+		t.Size += c.Size
 		cube = cube.Child
 	}
 
 	return utils.ToJSON(t)
 }
 
-// Read header from current cube.
-func (t *Tray) unpackHeader() error {
-	return nil
+// Read header from serialized tray metadata.
+func (t *Tray) unpackHeader(buf []byte) error {
+	return json.Unmarshal(buf, t)
 }
@@ -19,6 +19,8 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
+	"path/filepath"
+	"strings"
 )
 
 // Serialize object to JSON.
@@ -30,3 +32,35 @@ func ToJSON(obj interface{}) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// Check if a path matches a glob pattern, either directly or through one of
+// its parent directories. Patterns starting with a slash are matched against
+// the whole path. Other patterns may match any run of its components, so
+// that etc/*.conf matches /etc/hosts.conf and *.conf matches a file name in
+// any directory.
+func MatchPath(pattern string, p string) (bool, error) {
+	p = filepath.Clean(p)
+	if filepath.IsAbs(pattern) {
+		return matchParents(pattern, p)
+	}
+	parts := strings.Split(strings.TrimPrefix(p, string(filepath.Separator)), string(filepath.Separator))
+	for i := range parts {
+		matched, err := matchParents(pattern, filepath.Join(parts[i:]...))
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// Check if a path or one of its parent directories matches a glob pattern.
+func matchParents(pattern string, p string) (bool, error) {
+	for p != "." && p != "/" && p != "" {
+		matched, err := filepath.Match(pattern, p)
+		if err != nil || matched {
+			return matched, err
+		}
+		p = filepath.Dir(p)
+	}
+	return false, nil
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package verifier
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/elliotpeele/deepfreeze/cube"
+	"github.com/elliotpeele/deepfreeze/fileinfo"
+	"github.com/elliotpeele/deepfreeze/indexer"
+	"github.com/elliotpeele/deepfreeze/log"
+	"github.com/elliotpeele/deepfreeze/molecule"
+	"github.com/elliotpeele/deepfreeze/thawer"
+	"github.com/elliotpeele/deepfreeze/tray"
+)
+
+// Problem found while verifying a backup.
+type Problem struct {
+	TrayId string `json:"tray_id"`
+	Id     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func (p *Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Id, p.Reason)
+}
+
+// High level backup verification structure.
+type Verifier struct {
+	tray      *tray.Tray
+	backupdir string
+}
+
+// Create a new verifier instance.
+func New(trayId string, backupdir string) (*Verifier, error) {
+	t, err := tray.Open(backupdir, trayId)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		tray:      t,
+		backupdir: backupdir,
+	}, nil
+}
+
+// Record a problem with the tray. Problems are reported by the caller.
+func (v *Verifier) problem(id string, format string, args ...interface{}) *Problem {
+	p := &Problem{
+		TrayId: v.tray.Id,
+		Id:     id,
+		Reason: fmt.Sprintf(format, args...),
+	}
+	log.Debugf("tray %s: %s", v.tray.Id, p)
+	return p
+}
+
+// Check the hash of every cube in the tray against the tray metadata.
+func (v *Verifier) VerifyCubes() ([]*Problem, error) {
+	var problems []*Problem
+	for _, cd := range v.tray.Cubes {
+		log.Infof("verifying cube %s", cd.Id)
+		c, err := cube.Open(cube.Path(v.backupdir, cd.Id))
+		if os.IsNotExist(err) {
+			problems = append(problems, v.problem(cd.Id, "missing"))
+			continue
+		}
+		if err != nil {
+			problems = append(problems, v.problem(cd.Id, "unreadable: %s", err))
+			continue
+		}
+		hash, size, err := c.ComputeHash()
+		c.Close()
+		if err != nil {
+			problems = append(problems, v.problem(cd.Id, "unreadable: %s", err))
+			continue
+		}
+		if size < cd.Size {
+			problems = append(problems, v.problem(cd.Id,
+				"truncated: %d of %d bytes", size, cd.Size))
+		} else if hash != cd.Hash {
+			problems = append(problems, v.problem(cd.Id, "corrupted: hash mismatch"))
+		}
+	}
+	return problems, nil
+}
+
+// Decrypt and decompress every file stored in the tray and compare the hash
+// of the content with the hash recorded when the file was indexed. Files
+// stored in parent trays are checked when those trays are verified. Every
+// file that fails to restore or match is reported.
+func (v *Verifier) VerifyMolecules(keyringdir string) ([]*Problem, error) {
+	t, err := thawer.New(v.tray.Id, v.backupdir, keyringdir, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var problems []*Problem
+	err = t.WalkTrayPacked(func(m *molecule.Molecule) error {
+		// The content of hard links is verified with the file they link to.
+		if m.LinkTo != "" {
+			return nil
+		}
+		log.Infof("verifying %s", m.Path)
+		h := sha512.New()
+		// The content is hashed as it is unpacked, without tmp copies.
+		// Directories, symlinks and special files have no stored content.
+		if m.Info().Size() > 0 {
+			r, err := m.Unpack()
+			if err != nil {
+				problems = append(problems, v.problem(m.Path, "unable to unpack: %s", err))
+				return nil
+			}
+			if _, err := io.Copy(h, r); err != nil {
+				problems = append(problems, v.problem(m.Path, "unable to unpack: %s", err))
+				return nil
+			}
+		}
+		sum := h.Sum(nil)
+		// Entries other than regular files are hashed by their description.
+		if info := m.OrigInfo(); info != nil && !info.Mode().IsRegular() {
+			special := indexer.HashSpecial(fileinfo.NewFileInfo(info))
+			sum = special[:]
+		}
+		if hash := fmt.Sprintf("%x", sum); hash != m.Hash {
+			problems = append(problems, v.problem(m.Path, "content hash mismatch"))
+		}
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, v.problem(v.tray.Id, "unable to restore: %s", err))
+	}
+	return problems, nil
+}
+
+// Stored state of a file in the tray.
+type storedFile struct {
+	hash string
+	info *fileinfo.FileInfo
+}
+
+// Get the path of p relative to root, or p itself if there is no root.
+func relPath(root string, p string) string {
+	if root == "" {
+		return p
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return p
+	}
+	return rel
+}
+
+// Compare the files in the tray with the live filesystem at root, reporting
+// files that were added, deleted, modified, or had their metadata changed.
+// Paths are compared relative to the root of the backup and root. The
+// filesystem is indexed with the same exclude rules as a backup.
+func (v *Verifier) VerifyAgainst(root string, excludes []string, excludeFrom []string) ([]*Problem, error) {
+	idx := indexer.New(root, excludes)
+	for _, path := range excludeFrom {
+		if err := idx.LoadExcludeFile(path); err != nil {
+			return nil, err
+		}
+	}
+	files, err := idx.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	// Incremental backups only hold changed files, compare with the state of
+	// the whole chain.
+	if err := v.tray.LoadParents(); err != nil {
+		return nil, err
+	}
+	stored := make(map[string]*storedFile)
+	for p, fd := range v.tray.Files() {
+		stored[relPath(v.tray.Root, p)] = &storedFile{
+			hash: fd.Hash,
+			info: fd.Info,
+		}
+	}
+
+	var problems []*Problem
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		rel := relPath(root, p)
+		sf, ok := stored[rel]
+		if !ok {
+			problems = append(problems, v.problem(rel, "added"))
+			continue
+		}
+		delete(stored, rel)
+		if fmt.Sprintf("%x", files[p]) != sf.hash {
+			problems = append(problems, v.problem(rel, "modified"))
+			continue
+		}
+		if sf.info == nil {
+			continue
+		}
+		info, err := fileinfo.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if changed := metadataChanges(sf.info, info); len(changed) > 0 {
+			problems = append(problems, v.problem(rel,
+				"metadata changed: %s", strings.Join(changed, ", ")))
+		}
+	}
+
+	var deleted []string
+	for rel := range stored {
+		deleted = append(deleted, rel)
+	}
+	sort.Strings(deleted)
+	for _, rel := range deleted {
+		problems = append(problems, v.problem(rel, "deleted"))
+	}
+	return problems, nil
+}
+
+// Get the names of the metadata fields that differ between the stored and
+// live file info.
+func metadataChanges(stored *fileinfo.FileInfo, live *fileinfo.FileInfo) []string {
+	var changed []string
+	if stored.Size != live.Size {
+		changed = append(changed, "size")
+	}
+	if stored.Mode != live.Mode {
+		changed = append(changed, "mode")
+	}
+	if stored.Uid != live.Uid {
+		changed = append(changed, "uid")
+	}
+	if stored.Gid != live.Gid {
+		changed = append(changed, "gid")
+	}
+	if !stored.ModTime.Equal(live.ModTime) {
+		changed = append(changed, "mtime")
+	}
+	if !stored.SameXattrs(live) {
+		changed = append(changed, "xattrs")
+	}
+	return changed
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) Elliot Peele <elliot@bentlogic.net>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package verifier
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elliotpeele/deepfreeze/cube"
+	"github.com/elliotpeele/deepfreeze/freezer"
+	"github.com/elliotpeele/deepfreeze/tray"
+)
+
+// Back up a tree of files below a new tmp directory, which is returned for
+// removal, with a verifier for the backup. The tree is backed up from root,
+// into backup with the keys in keys.
+func backupTree(t *testing.T, files map[string]string) (string, *Verifier) {
+	dir, err := ioutil.TempDir("", "testsuite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	backupdir := filepath.Join(dir, "backup")
+	keydir := filepath.Join(dir, "keys")
+	for _, p := range []string{root, backupdir, keydir} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := freezer.New(root, backupdir, keydir, nil, nil, freezer.Full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := tray.Latest(backupdir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(tr.Id, backupdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, v
+}
+
+// Check that exactly the expected problems were found, keyed by id.
+func checkProblems(t *testing.T, problems []*Problem, expected map[string]string) {
+	found := make(map[string]string)
+	for _, p := range problems {
+		found[p.Id] = p.Reason
+	}
+	if len(found) != len(expected) || len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, found %v", len(expected), found)
+	}
+	for id, reason := range expected {
+		if found[id] != reason {
+			t.Fatalf("unexpected problem for %s: %q", id, found[id])
+		}
+	}
+}
+
+func TestVerifyCubes(t *testing.T) {
+	dir, v := backupTree(t, map[string]string{"a": "alpha", "b": "bravo"})
+	defer os.RemoveAll(dir)
+
+	problems, err := v.VerifyCubes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(t, problems, nil)
+
+	cd := v.tray.Cubes[0]
+	path := cube.Path(v.backupdir, cd.Id)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = v.VerifyCubes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(t, problems, map[string]string{cd.Id: "corrupted: hash mismatch"})
+
+	// Cut the cube in half, keeping the cube header.
+	size := len(data) - int(cd.Size/2)
+	if err := os.Truncate(path, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = v.VerifyCubes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Id != cd.Id || !strings.HasPrefix(problems[0].Reason, "truncated:") {
+		t.Fatalf("expected %s to be reported as truncated, found %v", cd.Id, problems)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = v.VerifyCubes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(t, problems, map[string]string{cd.Id: "missing"})
+}
+
+func TestVerifyMolecules(t *testing.T) {
+	dir, v := backupTree(t, map[string]string{
+		"a": strings.Repeat("alpha", 1000),
+		"b": "bravo",
+	})
+	defer os.RemoveAll(dir)
+	keydir := filepath.Join(dir, "keys")
+
+	problems, err := v.VerifyMolecules(keydir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(t, problems, nil)
+
+	// Change a byte in the middle of the largest atom of a.
+	path := filepath.Join(dir, "root", "a")
+	fd := v.tray.Files()[path]
+	a := fd.Atoms[0]
+	for _, other := range fd.Atoms {
+		if other.Size > a.Size {
+			a = other
+		}
+	}
+	cubePath := cube.Path(v.backupdir, a.CubeId)
+	data, err := ioutil.ReadFile(cubePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(cubePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := tar.NewReader(f)
+	var content []byte
+	for {
+		hdr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == a.Id {
+			if content, err = ioutil.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	offset := bytes.Index(data, content)
+	if offset < 0 {
+		t.Fatalf("unable to find atom %s", a.Id)
+	}
+	data[offset+len(content)/2] ^= 0xff
+	if err := ioutil.WriteFile(cubePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = v.VerifyMolecules(keydir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Id != path || !strings.HasPrefix(problems[0].Reason, "unable to unpack:") {
+		t.Fatalf("expected %s to be reported as unreadable, found %v", path, problems)
+	}
+}
+
+func TestVerifyAgainst(t *testing.T) {
+	dir, v := backupTree(t, map[string]string{
+		"a": "alpha",
+		"b": "bravo",
+		"c": "charlie",
+		"d": "delta",
+	})
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+
+	problems, err := v.VerifyAgainst(root, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProblems(t, problems, nil)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("alpha changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "c"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "e"), []byte("echo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = v.VerifyAgainst(root, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Adding and removing files changes the root directory as well.
+	checkProblems(t, problems, map[string]string{
+		".": "metadata changed: mtime",
+		"a": "modified",
+		"b": "deleted",
+		"c": "metadata changed: mode",
+		"e": "added",
+	})
+}